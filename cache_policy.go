@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// fingerprint matches the token before the extension, which may be a content hash such as `main.3f2a9c1b.js` or `index-BxK3aF9q.js`
+	fingerprint = regexp.MustCompile(`[.-]([A-Za-z0-9_]{8,})(\.[A-Za-z0-9]+)$`)
+	// hexHash is a hex digest, such as webpack's `[contenthash]`
+	hexHash = regexp.MustCompile(`^[0-9a-f]+$`)
+	// wordAndNumber is a word and a number, such as `section10`, `2024review` or `Products1`
+	wordAndNumber = regexp.MustCompile(`^([A-Za-z_]+[0-9]+|[0-9]+[A-Za-z_]+)$`)
+)
+
+// CachePolicy is the default Cache-Control header of served files.
+// A Cache-Control header set by a _headers rule always takes precedence.
+// An empty value means no default header.
+type CachePolicy struct {
+	// Default is used for every file
+	Default string
+	// Immutable is used for files with a content hash in their names
+	Immutable string
+}
+
+// DefaultCachePolicy mimics Netlify, which revalidates everything but fingerprinted assets
+var DefaultCachePolicy = CachePolicy{
+	Default:   "public, max-age=0, must-revalidate",
+	Immutable: "public, max-age=31536000, immutable",
+}
+
+// apply sets the default Cache-Control header of the file, unless it's already set
+func (policy *CachePolicy) apply(header http.Header, file string) {
+	if policy == nil || header.Get("Cache-Control") != "" {
+		return
+	}
+	value := policy.Default
+	if policy.Immutable != "" && isFingerprinted(filepath.Base(file)) {
+		value = policy.Immutable
+	}
+	if value != "" {
+		header.Set("Cache-Control", value)
+	}
+}
+
+// isFingerprinted returns true if the file name carries a content hash.
+// A wrong guess caches the file for a year, so only tokens which look like a hash count:
+// a hex digest, or base64 with both cases and digits, and never a word, a number or a date.
+// Pages are never fingerprinted, since their urls must stay the same.
+func isFingerprinted(name string) bool {
+	m := fingerprint.FindStringSubmatch(name)
+	if m == nil {
+		return false
+	}
+	token, ext := m[1], strings.ToLower(m[2])
+	if ext == ".html" || ext == ".htm" {
+		return false
+	}
+	// a hash mixes digits and letters, a number may be a date
+	if !strings.ContainsAny(token, "0123456789") || strings.Trim(token, "0123456789") == "" || wordAndNumber.MatchString(token) {
+		return false
+	}
+	if hexHash.MatchString(token) {
+		return true
+	}
+	return strings.ToLower(token) != token && strings.ToUpper(token) != token
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsFingerprinted(t *testing.T) {
+	for _, name := range []string{"main.3f2a9c1b.js", "index-BxK3aF9q.js", "app.min.3f2a9c1bd4e5.css", "logo.8e1f0c2a.svg"} {
+		require.True(t, isFingerprinted(name), name)
+	}
+	for _, name := range []string{
+		"main.js", "index.html", "app-defaults.js", "jquery-3.6.0.min.js", "3f2a9c1b.js", "vendor-12345678.js",
+		"chapter-section10.html", "privacy-policy2023.html", "blog-2024review.html", "sitemap-products1.xml", "report-20240115.pdf",
+		"about.3f2a9c1b.html", "intro-Chapter10.pdf",
+	} {
+		require.False(t, isFingerprinted(name), name)
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	header := http.Header{}
+	DefaultCachePolicy.apply(header, "/site/index.html")
+	require.Equal(t, "public, max-age=0, must-revalidate", header.Get("Cache-Control"))
+
+	header = http.Header{}
+	DefaultCachePolicy.apply(header, "/site/main.3f2a9c1b.js")
+	require.Equal(t, "public, max-age=31536000, immutable", header.Get("Cache-Control"))
+
+	// set by _headers
+	header = http.Header{"Cache-Control": []string{"no-store"}}
+	DefaultCachePolicy.apply(header, "/site/main.3f2a9c1b.js")
+	require.Equal(t, "no-store", header.Get("Cache-Control"))
+
+	header = http.Header{}
+	(&CachePolicy{}).apply(header, "/site/index.html")
+	require.Equal(t, "", header.Get("Cache-Control"))
+
+	header = http.Header{}
+	(&CachePolicy{Default: "no-cache"}).apply(header, "/site/main.3f2a9c1b.js")
+	require.Equal(t, "no-cache", header.Get("Cache-Control"))
+
+	var policy *CachePolicy
+	header = http.Header{}
+	policy.apply(header, "/site/index.html")
+	require.Equal(t, "", header.Get("Cache-Control"))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressMinSize is the minimum body size worth compressing
+const compressMinSize = 1024
+
+// compressibleTypes are text-like content types which should be compressed
+var compressibleTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// isCompressible returns true if the given content type is text-like
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	for _, t := range compressibleTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter compresses the response on the fly with the encoding accepted by the client.
+// The body is buffered until we know it's large enough to be worth compressing.
+// Responses which are already encoded, partial, or not text-like are passed through.
+type compressWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	status  int
+	buf     []byte
+	decided bool
+	encoder io.WriteCloser
+	// fileType and fileSize describe the file being served, see setServedFile
+	fileType string
+	fileSize int64
+}
+
+func newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	return &compressWriter{ResponseWriter: w, r: r, status: 200}
+}
+
+// WriteHeader defers the status code until we decide whether to compress
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided {
+		return
+	}
+	cw.status = status
+	// no need to wait for the body if we know its size and type
+	length, err := strconv.Atoi(cw.Header().Get("Content-Length"))
+	if err == nil && length >= compressMinSize && cw.Header().Get("Content-Type") != "" {
+		cw.decide()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) >= compressMinSize {
+			cw.decide()
+		}
+		return len(b), nil
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Close flushes buffered body and finishes the compressed stream
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		cw.decide()
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
+
+// decide writes the header and starts compression if the response should be compressed
+func (cw *compressWriter) decide() {
+	cw.decided = true
+	header := cw.Header()
+
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		// sniff before compression, or the client will see the type of compressed data
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if cw.shouldCompress() {
+		encoding := ""
+		if acceptsEncoding(cw.r, "br") {
+			encoding = "br"
+			cw.encoder = brotli.NewWriter(cw.ResponseWriter)
+		} else if acceptsEncoding(cw.r, "gzip") {
+			encoding = "gzip"
+			cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+		}
+		if cw.encoder != nil {
+			header.Set("Content-Encoding", encoding)
+			header.Del("Content-Length")
+			header.Del("Accept-Ranges")
+			weakenETag(header)
+		}
+	} else if cw.status == 304 && isCompressible(cw.fileType) {
+		// a 304 has no body, but caches match it with the response they stored,
+		// so it needs the Vary and ETag the file would have been compressed with
+		addVary(header, "Accept-Encoding")
+		if cw.fileSize >= compressMinSize && (acceptsEncoding(cw.r, "br") || acceptsEncoding(cw.r, "gzip")) {
+			weakenETag(header)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		cw.Write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+// weakenETag marks the ETag as weak.
+// The compressed body is a different representation, it's only weakly equal to the original.
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// setServedFile tells the compressing writer the type and size of the file being served.
+// http.ServeContent removes them from the header of a 304, which still needs the headers of the compressed response.
+func setServedFile(w http.ResponseWriter, contentType string, size int64) {
+	if hw, ok := w.(*hookWriter); ok {
+		w = hw.ResponseWriter
+	}
+	if cw, ok := w.(*compressWriter); ok {
+		cw.fileType = contentType
+		cw.fileSize = size
+	}
+}
+
+// shouldCompress returns true if the response is text-like, large enough, and not encoded yet
+func (cw *compressWriter) shouldCompress() bool {
+	header := cw.Header()
+	if cw.r.Method == "HEAD" || cw.r.Header.Get("Range") != "" {
+		return false
+	}
+	if cw.status < 200 || cw.status == 204 || cw.status == 206 || cw.status == 304 {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || !isCompressible(header.Get("Content-Type")) {
+		return false
+	}
+	// caches should know the response depends on Accept-Encoding, even if we don't compress this one
+	addVary(header, "Accept-Encoding")
+
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		length = len(cw.buf)
+	}
+	return length >= compressMinSize
+}
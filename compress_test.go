@@ -0,0 +1,197 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsCompressible(t *testing.T) {
+	require.True(t, isCompressible("text/html; charset=utf-8"))
+	require.True(t, isCompressible("text/css"))
+	require.True(t, isCompressible("application/javascript"))
+	require.True(t, isCompressible("application/json"))
+	require.True(t, isCompressible("application/ld+json"))
+	require.True(t, isCompressible("image/svg+xml"))
+	require.False(t, isCompressible("image/png"))
+	require.False(t, isCompressible("application/octet-stream"))
+	require.False(t, isCompressible(""))
+}
+
+func TestCompressGzip(t *testing.T) {
+	body := strings.Repeat("hello world\n", 200)
+	rec := compress(t, "gzip", "", func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"abc"`)
+		w.Write([]byte(body))
+	})
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	require.Equal(t, `W/"abc"`, rec.Header().Get("ETag"))
+
+	r, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, body, string(data))
+}
+
+func TestCompressBrotli(t *testing.T) {
+	body := strings.Repeat("<p>hello world</p>\n", 200)
+	rec := compress(t, "gzip, br", "", func(w http.ResponseWriter) {
+		w.Header().Set("Content-Length", "3800")
+		w.WriteHeader(404)
+		w.Write([]byte(body))
+	})
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "br", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "", rec.Header().Get("Content-Length"))
+	require.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	data, err := ioutil.ReadAll(brotli.NewReader(rec.Body))
+	require.NoError(t, err)
+	require.Equal(t, body, string(data))
+}
+
+func TestCompressSkipped(t *testing.T) {
+	large := strings.Repeat("a", 2048)
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		rangeHeader    string
+		handler        func(w http.ResponseWriter)
+	}{
+		{"not accepted", "", "", func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(large))
+		}},
+		{"small body", "gzip", "", func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("small"))
+		}},
+		{"binary", "gzip", "", func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		}},
+		{"already encoded", "gzip", "", func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte(large))
+		}},
+		{"range request", "gzip", "bytes=0-10", func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(206)
+			w.Write([]byte(large[:11]))
+		}},
+	}
+	for _, c := range cases {
+		rec := compress(t, c.acceptEncoding, c.rangeHeader, c.handler)
+		require.NotEqual(t, "gzip", rec.Header().Get("Content-Encoding"), c.name)
+	}
+}
+
+func TestCompressServer(t *testing.T) {
+	html := strings.Repeat("<p>hello</p>\n", 200)
+	server := testServer(t, Config{Compress: true}, map[string]string{
+		"_redirects": "/ /index.html 200",
+		"index.html": html,
+		"small.css":  "body {}",
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+
+	r, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, html, string(data))
+
+	req, _ = http.NewRequest("GET", "/small.css", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "body {}", rec.Body.String())
+
+	req, _ = http.NewRequest("GET", "/index.html", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-2")
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, 206, rec.Code)
+	require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "<p>", rec.Body.String())
+}
+
+func TestCompressNotModified(t *testing.T) {
+	server := testServer(t, Config{Compress: true}, map[string]string{
+		"index.html": strings.Repeat("<p>hello</p>\n", 200),
+		"small.css":  "body {}",
+	})
+
+	req, _ := http.NewRequest("GET", "/index.html", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	etag := rec.Header().Get("ETag")
+	require.True(t, strings.HasPrefix(etag, "W/"), etag)
+
+	// the 304 has the same validator and Vary as the compressed response it validates
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, 304, rec.Code)
+	require.Equal(t, etag, rec.Header().Get("ETag"))
+	require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+
+	// an uncompressed response keeps its strong ETag, but still varies
+	req.Header.Del("Accept-Encoding")
+	req.Header.Set("If-None-Match", strings.TrimPrefix(etag, "W/"))
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, 304, rec.Code)
+	require.Equal(t, strings.TrimPrefix(etag, "W/"), rec.Header().Get("ETag"))
+	require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+
+	// files too small to compress keep their strong ETag
+	req, _ = http.NewRequest("GET", "/small.css", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, 304, rec.Code)
+	require.False(t, strings.HasPrefix(rec.Header().Get("ETag"), "W/"))
+	require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+}
+
+func compress(t *testing.T, acceptEncoding string, rangeHeader string, handler func(w http.ResponseWriter)) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	rec := httptest.NewRecorder()
+	cw := newCompressWriter(rec, req)
+	handler(cw)
+	require.NoError(t, cw.Close())
+	return rec
+}
@@ -2,3 +2,18 @@ package main
 
 // METHODS contains all http methods we support
 var METHODS = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH"}
+
+// hasMethod returns true if method is one of the given methods
+func hasMethod(methods []string, method string) bool {
+	return contains(methods, method)
+}
+
+// contains returns true if s is in the list
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy is the CORS configuration of a `CORS` line in _headers, such as
+// `CORS: origins=https://*.example.com methods=GET,POST headers=Content-Type credentials=true max-age=600`.
+type corsPolicy struct {
+	// origins are patterns of allowed origins, `*` matches any characters except `/`, or any origin on its own
+	origins []*regexp.Regexp
+	// Methods are allowed methods of preflight requests
+	Methods []string
+	// Headers are allowed request headers, `*` allows any requested header
+	Headers []string
+	// Expose are response headers readable by scripts
+	Expose      []string
+	Credentials bool
+	// MaxAge is how long a preflight response can be cached in seconds, it's not sent if it's zero
+	MaxAge int
+}
+
+// parseCORS returns the CORS policy of given options
+func parseCORS(value string) (*corsPolicy, error) {
+	cors := &corsPolicy{Methods: []string{"GET", "HEAD", "POST"}}
+	anyOrigin := false
+	for _, option := range strings.Fields(value) {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) < 2 || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid CORS option: %s", option)
+		}
+		list := strings.Split(kv[1], ",")
+		switch strings.ToLower(kv[0]) {
+		case "origins":
+			for _, origin := range list {
+				expr := strings.Replace(regexp.QuoteMeta(strings.TrimSuffix(origin, "/")), `\*`, "[^/]*", -1)
+				if origin == "*" {
+					anyOrigin = true
+					expr = ".*"
+				}
+				cors.origins = append(cors.origins, regexp.MustCompile("(?i)^"+expr+"$"))
+			}
+		case "methods":
+			cors.Methods = nil
+			for _, method := range list {
+				method = strings.ToUpper(method)
+				if !hasMethod(METHODS, method) {
+					return nil, fmt.Errorf("Invalid CORS method: %s", method)
+				}
+				cors.Methods = append(cors.Methods, method)
+			}
+		case "headers":
+			for _, h := range list {
+				if h != "*" {
+					h = http.CanonicalHeaderKey(h)
+				}
+				cors.Headers = append(cors.Headers, h)
+			}
+		case "expose":
+			for _, h := range list {
+				cors.Expose = append(cors.Expose, http.CanonicalHeaderKey(h))
+			}
+		case "credentials":
+			credentials, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CORS credentials: %s", option)
+			}
+			cors.Credentials = credentials
+		case "max-age":
+			maxAge, err := strconv.Atoi(kv[1])
+			if err != nil || maxAge < 0 {
+				return nil, fmt.Errorf("Invalid CORS max-age: %s", option)
+			}
+			cors.MaxAge = maxAge
+		default:
+			return nil, fmt.Errorf("Invalid CORS option: %s", option)
+		}
+	}
+	if len(cors.origins) == 0 {
+		return nil, fmt.Errorf("CORS requires origins: %s", value)
+	}
+	// reflecting any origin with credentials would let every site act as the user
+	if anyOrigin && cors.Credentials {
+		return nil, fmt.Errorf("CORS can't allow credentials from any origin: %s", value)
+	}
+	return cors, nil
+}
+
+// allowsOrigin returns true if the origin matches any of the allowed origins
+func (cors *corsPolicy) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, re := range cors.origins {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPreflight returns true if the request is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// preflight answers a preflight request with 204.
+// Browsers reject the actual request if the response has no CORS headers, so a disallowed origin gets none.
+func (cors *corsPolicy) preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	addVary(h, "Origin")
+	addVary(h, "Access-Control-Request-Method")
+	addVary(h, "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	if cors.allowsOrigin(origin) {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Methods", strings.Join(cors.Methods, ", "))
+		if contains(cors.Headers, "*") {
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+		} else if len(cors.Headers) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(cors.Headers, ", "))
+		}
+		if cors.Credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if cors.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+		}
+	}
+	w.WriteHeader(204)
+}
+
+// setHeaders adds CORS headers of an actual request to the response header.
+// The policy overrides CORS headers of a proxied response.
+func (cors *corsPolicy) setHeaders(h http.Header, r *http.Request) {
+	addVary(h, "Origin")
+	origin := r.Header.Get("Origin")
+	if !cors.allowsOrigin(origin) {
+		h.Del("Access-Control-Allow-Origin")
+		h.Del("Access-Control-Allow-Credentials")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if cors.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(cors.Expose) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(cors.Expose, ", "))
+	}
+}
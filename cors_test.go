@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCORS(t *testing.T) {
+	cors, err := parseCORS("origins=https://*.example.com,https://app.test methods=get,put headers=content-type,x-token expose=x-total credentials=true max-age=600")
+	require.NoError(t, err)
+	require.Equal(t, []string{"GET", "PUT"}, cors.Methods)
+	require.Equal(t, []string{"Content-Type", "X-Token"}, cors.Headers)
+	require.Equal(t, []string{"X-Total"}, cors.Expose)
+	require.True(t, cors.Credentials)
+	require.Equal(t, 600, cors.MaxAge)
+
+	require.True(t, cors.allowsOrigin("https://docs.example.com"))
+	require.True(t, cors.allowsOrigin("https://APP.test"))
+	require.False(t, cors.allowsOrigin("https://example.com.evil.test"))
+	require.False(t, cors.allowsOrigin("http://docs.example.com"))
+	require.False(t, cors.allowsOrigin("https://app.test.evil.test"))
+	require.False(t, cors.allowsOrigin(""))
+
+	cors, err = parseCORS("origins=*")
+	require.NoError(t, err)
+	require.True(t, cors.allowsOrigin("https://anything.test"))
+	require.Equal(t, []string{"GET", "HEAD", "POST"}, cors.Methods)
+
+	for _, invalid := range []string{
+		"",
+		"methods=GET",
+		"origins=* credentials=true",
+		"origins=https://app.test methods=FETCH",
+		"origins=https://app.test credentials=maybe",
+		"origins=https://app.test max-age=-1",
+		"origins=https://app.test unknown=1",
+		"origins=",
+	} {
+		_, err = parseCORS(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestPathCORS(t *testing.T) {
+	ts := mockServer()
+	defer ts.Close()
+	server := testServer(t, Config{}, map[string]string{
+		"_headers": `
+/api/*
+  CORS: origins=https://*.example.com methods=GET,POST,DELETE headers=* credentials=true max-age=600 expose=X-Total
+  Basic-Auth: user:pass
+/data.json
+  CORS: origins=https://app.test
+`,
+		"_redirects": "/api/* " + ts.URL + "/:splat 200",
+		"data.json":  "{}",
+	})
+
+	cors := func(method string, url string, origin string) *http.Request {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set("Origin", origin)
+		return req
+	}
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// preflights are answered directly, without auth and without the proxied server
+	req := cors("OPTIONS", "/api/users", "https://docs.example.com")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	req.Header.Set("Access-Control-Request-Headers", "authorization, x-token")
+	rec := send(req)
+	require.Equal(t, 204, rec.Code)
+	require.Empty(t, rec.Body.String())
+	require.Equal(t, "https://docs.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, POST, DELETE", rec.Header().Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "authorization, x-token", rec.Header().Get("Access-Control-Allow-Headers"))
+	require.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "600", rec.Header().Get("Access-Control-Max-Age"))
+	require.Contains(t, rec.Header().Values("Vary"), "Origin")
+
+	req = cors("OPTIONS", "/api/users", "https://evil.test")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	rec = send(req)
+	require.Equal(t, 204, rec.Code)
+	require.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// an OPTIONS request which is not a preflight goes on as usual
+	rec = send(cors("OPTIONS", "/api/users", "https://docs.example.com"))
+	require.Equal(t, 401, rec.Code)
+
+	// actual requests get CORS headers, including a proxied response
+	req = cors("DELETE", "/api/users", "https://docs.example.com")
+	req.SetBasicAuth("user", "pass")
+	rec = send(req)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "METHOD: DELETE", rec.Body.String())
+	require.Equal(t, "https://docs.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "X-Total", rec.Header().Get("Access-Control-Expose-Headers"))
+
+	rec = send(cors("GET", "/data.json", "https://app.test"))
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "https://app.test", rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+
+	rec = send(cors("GET", "/data.json", "https://evil.test"))
+	require.Equal(t, 200, rec.Code)
+	require.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "Origin", rec.Header().Get("Vary"))
+}
+
+func TestCORSPreflightAfterAuthPath(t *testing.T) {
+	server := testServer(t, Config{}, map[string]string{
+		"_headers": `
+/*
+  Basic-Auth: user:pass
+/admin/*
+  IP-Deny: 192.0.2.0/24
+/api/*
+  CORS: origins=https://app.test methods=GET,PUT
+/admin/*
+  CORS: origins=https://app.test
+`,
+		"api/x.json": "{}",
+	})
+
+	preflight := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("OPTIONS", url, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Origin", "https://app.test")
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		rec := httptest.NewRecorder()
+		server.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the preflight is answered by the CORS path, although `/*` requires auth
+	rec := preflight("/api/x.json")
+	require.Equal(t, 204, rec.Code)
+	require.Equal(t, "https://app.test", rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, PUT", rec.Header().Get("Access-Control-Allow-Methods"))
+
+	// earlier network restrictions still apply
+	require.Equal(t, 403, preflight("/admin/x").Code)
+
+	// paths without CORS still require auth
+	require.Equal(t, 401, preflight("/other.json").Code)
+
+	// the actual request requires auth
+	req, _ := http.NewRequest("PUT", "/api/x.json", nil)
+	req.Header.Set("Origin", "https://app.test")
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, 401, rec.Code)
+}
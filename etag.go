@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// contentHashes caches content hashes of served files
+var contentHashes = newHashCache()
+
+// hashCache caches the content hash of files.
+// An entry is invalidated when the size or modification time of the file changes.
+type hashCache struct {
+	mutex   sync.Mutex
+	entries map[string]hashEntry
+}
+
+type hashEntry struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{entries: make(map[string]hashEntry)}
+}
+
+// hash returns the hex encoded sha256 of the file content
+func (cache *hashCache) hash(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+
+	cache.mutex.Lock()
+	entry, ok := cache.entries[file]
+	cache.mutex.Unlock()
+	if ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return entry.Hash, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	entry = hashEntry{info.Size(), info.ModTime(), hex.EncodeToString(h.Sum(nil))}
+
+	cache.mutex.Lock()
+	cache.entries[file] = entry
+	cache.mutex.Unlock()
+	return entry.Hash, nil
+}
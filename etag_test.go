@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashCache(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.txt": "hello"})
+	file := filepath.Join(dir, "a.txt")
+	cache := newHashCache()
+
+	hash, err := cache.hash(file)
+	require.NoError(t, err)
+	require.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", hash)
+
+	hash, err = cache.hash(file)
+	require.NoError(t, err)
+	require.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", hash)
+
+	// invalidated on change
+	require.NoError(t, ioutil.WriteFile(file, []byte("world"), 0644))
+	require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(time.Minute)))
+	hash, err = cache.hash(file)
+	require.NoError(t, err)
+	require.Equal(t, "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7", hash)
+
+	_, err = cache.hash(filepath.Join(dir, "missing.txt"))
+	require.Error(t, err)
+}
@@ -1,34 +1,385 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
+	urlpath "path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // FileServer serves a directory to the web using HTTP.
-// It works like http.FileServer, but without directory index (returns 404 when accessing a directory).
+// It works like http.FileServer, but without directory listing (returns 404 when accessing a directory without index.html).
 type FileServer struct {
-	WorkingDir string
+	WorkingDir    string
+	TrailingSlash TrailingSlash
+	CachePolicy   *CachePolicy
 }
 
 func (s FileServer) Match(r *http.Request) bool {
-	return !strings.HasSuffix(r.URL.Path, "/")
+	_, _, ok := resolveFile(s.WorkingDir, r.URL.Path)
+	return ok
 }
 
 // ServeHTTP Serving static files without director index
 func (s FileServer) Handle(w http.ResponseWriter, r *http.Request) bool {
-	if !s.Match(r) {
+	file, isIndex, ok := resolveFile(s.WorkingDir, r.URL.Path)
+	if !ok {
 		return true
 	}
 
-	path := r.URL.Path
+	if canonical := s.TrailingSlash.canonical(r.URL.Path, isIndex); canonical != r.URL.Path {
+		redirectCanonical(w, r, canonical)
+		return false
+	}
+
+	s.CachePolicy.apply(w.Header(), file)
+	serveFile(w, r, file)
+	return false
+}
+
+// ruleFiles are config files of SiteX, they should never be served
+var ruleFiles = []string{"_redirects", "_headers", "_ratelimits", passwordPage}
+
+// privateFiles are files which should never be served, such as htpasswd files referenced by _headers
+var privateFiles = struct {
+	sync.RWMutex
+	files map[string]bool
+}{files: make(map[string]bool)}
 
-	path = filepath.Join(s.WorkingDir, path[1:])
-	if _, err := os.Stat(path); !os.IsNotExist(err) {
-		http.ServeFile(w, r, path)
+// addPrivateFile prevents the file from being served
+func addPrivateFile(file string) {
+	if real, err := filepath.EvalSymlinks(file); err == nil {
+		file = real
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	privateFiles.Lock()
+	privateFiles.files[file] = true
+	privateFiles.Unlock()
+}
+
+// isPrivateFile returns true if the file is added by addPrivateFile
+func isPrivateFile(file string) bool {
+	if real, err := filepath.EvalSymlinks(file); err == nil {
+		file = real
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	privateFiles.RLock()
+	defer privateFiles.RUnlock()
+	return privateFiles.files[file]
+}
+
+// resolveFile returns the file which should be served for the given url path.
+// `/about` and `/about/` both resolve to the file `about` or to `about/index.html`.
+// isIndex is true if the path is resolved to a directory index.
+//
+// The resolved file is guaranteed to be inside root, even with symlinks. Paths containing `..` are never resolved.
+// Hidden files (except `.well-known`) and rule files are never resolved.
+func resolveFile(root string, urlPath string) (file string, isIndex bool, ok bool) {
+	if root == "" {
+		root = "."
+	}
+	// rules are matched with the request path, so a file must not be reachable by another path
+	if containsDotDot(urlPath) {
+		return "", false, false
+	}
+	// clean as an absolute path, so `..` can't go above root
+	rel := filepath.Join(string(filepath.Separator), filepath.FromSlash(trimTrailingSlash(urlPath)))
+	if !isServable(rel) {
+		return "", false, false
+	}
+
+	file = filepath.Join(root, rel)
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", false, false
+	}
+	if info.IsDir() {
+		file = filepath.Join(file, "index.html")
+		info, err = os.Stat(file)
+		if err != nil || info.IsDir() {
+			return "", false, false
+		}
+		isIndex = true
+	}
+
+	if !isInside(root, file) || isPrivateFile(file) {
+		return "", false, false
+	}
+	return file, isIndex, true
+}
+
+// containsDotDot returns true if the url path has a `..` segment, like http.ServeFile
+func containsDotDot(urlPath string) bool {
+	if !strings.Contains(urlPath, "..") {
 		return false
 	}
+	for _, segment := range strings.FieldsFunc(urlPath, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath removes empty and `.` segments of a url path, keeping the trailing slash.
+// `..` segments should be rejected before, see containsDotDot.
+func cleanPath(urlPath string) string {
+	if urlPath == "" || urlPath[0] != '/' {
+		urlPath = "/" + urlPath
+	}
+	clean := urlpath.Clean(urlPath)
+	if clean != "/" && strings.HasSuffix(urlPath, "/") {
+		clean += "/"
+	}
+	return clean
+}
+
+// isServable returns false if the cleaned path contains a hidden file or a rule file
+func isServable(rel string) bool {
+	for _, segment := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(segment, ".") && segment != ".well-known" {
+			return false
+		}
+		for _, ruleFile := range ruleFiles {
+			if strings.EqualFold(segment, ruleFile) {
+				return false
+			}
+		}
+	}
 	return true
 }
+
+// isInside returns true if the file is inside root after resolving symlinks
+func isInside(root string, file string) bool {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	realFile, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(realRoot, realFile)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && isServable(rel)
+}
+
+// precompressed are file extensions of precompressed variants and their content encoding, by preference
+var precompressed = []struct {
+	Ext      string
+	Encoding string
+}{
+	{".br", "br"},
+	{".gz", "gzip"},
+}
+
+// serveFile replies to the request with the content of the given file.
+// Unlike http.ServeFile, it never redirects or lists directories.
+// A precompressed sibling such as `app.js.br` is served instead if the client accepts its encoding.
+func serveFile(w http.ResponseWriter, r *http.Request, file string) {
+	name := filepath.Base(file)
+	original := file
+	for _, variant := range precompressed {
+		// symlinks are ignored, so a variant can't point outside of the site
+		info, err := os.Lstat(original + variant.Ext)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		addVary(w.Header(), "Accept-Encoding")
+		if file == original && acceptsEncoding(r, variant.Encoding) {
+			w.Header().Set("Content-Encoding", variant.Encoding)
+			file = original + variant.Ext
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	// a strong ETag based on content, so caches survive a fresh checkout.
+	// http.ServeContent answers If-None-Match with 304 based on it.
+	if w.Header().Get("ETag") == "" {
+		if hash, err := contentHashes.hash(file); err == nil {
+			w.Header().Set("ETag", `"`+hash+`"`)
+		}
+	}
+	if w.Header().Get("Content-Encoding") == "" {
+		setServedFile(w, mime.TypeByExtension(filepath.Ext(name)), info.Size())
+	}
+	// use the original name so the content type is detected from the original file
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// addVary adds a field name to the Vary header unless it's already there
+func addVary(header http.Header, field string) {
+	for _, value := range header["Vary"] {
+		for _, f := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", field)
+}
+
+// acceptsEncoding returns true if the client accepts the given content encoding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	accepted := false
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != encoding && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// an exact match takes precedence over "*"
+		if coding == encoding {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// serveFileWithStatus replies to the request with the content of the given file and status code,
+// such as a custom 404 page. It works without conditional or range requests.
+// The default status text is used as body if the file doesn't exist.
+func serveFileWithStatus(w http.ResponseWriter, r *http.Request, file string, status int) {
+	if status == 200 {
+		serveFile(w, r, file)
+		return
+	}
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
+
+// TrailingSlash is the policy of trailing slashes in urls of static files
+type TrailingSlash int
+
+const (
+	// TrailingSlashAsIs serves `/about` and `/about/` without redirect
+	TrailingSlashAsIs TrailingSlash = iota
+	// TrailingSlashAdd redirects `/about` to `/about/` if it's a directory index
+	TrailingSlashAdd
+	// TrailingSlashStrip redirects `/about/` to `/about`
+	TrailingSlashStrip
+)
+
+// ParseTrailingSlash returns the policy of given name: "as-is", "add" or "strip"
+func ParseTrailingSlash(name string) (TrailingSlash, error) {
+	switch name {
+	case "as-is", "":
+		return TrailingSlashAsIs, nil
+	case "add":
+		return TrailingSlashAdd, nil
+	case "strip":
+		return TrailingSlashStrip, nil
+	}
+	return TrailingSlashAsIs, fmt.Errorf("Invalid trailing slash policy: %s", name)
+}
+
+// TrailingSlashRedirect redirects GET and HEAD requests to the canonical path of the trailing slash policy.
+// It runs before any rule, so redirect rules, header rules and static files are matched with the same path.
+//
+// With TrailingSlashStrip, any path with a trailing slash is redirected.
+// With TrailingSlashAdd, only paths of static files are redirected, since other paths have no index to tell.
+type TrailingSlashRedirect struct {
+	WorkingDir    string
+	TrailingSlash TrailingSlash
+}
+
+func (ts TrailingSlashRedirect) Match(r *http.Request) bool {
+	_, ok := ts.lookup(r)
+	return ok
+}
+
+// lookup returns the canonical path if the request should be redirected
+func (ts TrailingSlashRedirect) lookup(r *http.Request) (string, bool) {
+	if ts.TrailingSlash == TrailingSlashAsIs || (r.Method != "GET" && r.Method != "HEAD") {
+		return "", false
+	}
+	_, isIndex, ok := resolveFile(ts.WorkingDir, r.URL.Path)
+	if !ok && ts.TrailingSlash == TrailingSlashAdd {
+		return "", false
+	}
+	canonical := ts.TrailingSlash.canonical(r.URL.Path, isIndex)
+	return canonical, canonical != r.URL.Path
+}
+
+// Handle redirects the request if it's not canonical
+func (ts TrailingSlashRedirect) Handle(w http.ResponseWriter, r *http.Request) bool {
+	canonical, ok := ts.lookup(r)
+	if !ok {
+		return true
+	}
+	redirectCanonical(w, r, canonical)
+	return false
+}
+
+// redirectCanonical permanently redirects the request to the canonical path, keeping the query string
+func redirectCanonical(w http.ResponseWriter, r *http.Request, canonical string) {
+	if r.URL.RawQuery != "" {
+		canonical += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, canonical, 301)
+}
+
+// canonical returns the canonical form of the url path under the policy
+func (policy TrailingSlash) canonical(urlPath string, isIndex bool) string {
+	if urlPath == "/" {
+		return urlPath
+	}
+	switch policy {
+	case TrailingSlashAdd:
+		if isIndex {
+			return trimTrailingSlash(urlPath) + "/"
+		}
+		return trimTrailingSlash(urlPath)
+	case TrailingSlashStrip:
+		return trimTrailingSlash(urlPath)
+	}
+	return urlPath
+}
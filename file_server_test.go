@@ -3,13 +3,15 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestFileServer(t *testing.T) {
-	server := FileServer{"./example"}
+	server := FileServer{WorkingDir: "./example"}
 
 	rec := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/", nil)
@@ -28,3 +30,242 @@ func TestFileServer(t *testing.T) {
 	server.Handle(rec, req)
 	require.Equal(t, 200, rec.Code)
 }
+
+func TestFileServerTrailingSlashAsIs(t *testing.T) {
+	server := FileServer{WorkingDir: "./example"}
+
+	for _, path := range []string{"/about", "/about/"} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		require.False(t, server.Handle(rec, req))
+		require.Equal(t, 200, rec.Code)
+		require.Equal(t, "<h1>about</h1>\n", rec.Body.String())
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/test.json/", nil)
+	require.False(t, server.Handle(rec, req))
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "{\"foo\": \"bar\"}\n", rec.Body.String())
+}
+
+func TestFileServerTrailingSlashAdd(t *testing.T) {
+	server := FileServer{WorkingDir: "./example", TrailingSlash: TrailingSlashAdd}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/about?x=1", nil)
+	require.False(t, server.Handle(rec, req))
+	require.Equal(t, 301, rec.Code)
+	require.Equal(t, "/about/?x=1", rec.Header().Get("Location"))
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/about/", nil)
+	require.False(t, server.Handle(rec, req))
+	require.Equal(t, 200, rec.Code)
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/test.json/", nil)
+	require.False(t, server.Handle(rec, req))
+	require.Equal(t, 301, rec.Code)
+	require.Equal(t, "/test.json", rec.Header().Get("Location"))
+}
+
+func TestFileServerTrailingSlashStrip(t *testing.T) {
+	server := FileServer{WorkingDir: "./example", TrailingSlash: TrailingSlashStrip}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/about/", nil)
+	require.False(t, server.Handle(rec, req))
+	require.Equal(t, 301, rec.Code)
+	require.Equal(t, "/about", rec.Header().Get("Location"))
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/about", nil)
+	require.False(t, server.Handle(rec, req))
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "<h1>about</h1>\n", rec.Body.String())
+}
+
+func TestParseTrailingSlash(t *testing.T) {
+	policy, err := ParseTrailingSlash("add")
+	require.NoError(t, err)
+	require.Equal(t, TrailingSlashAdd, policy)
+
+	policy, err = ParseTrailingSlash("strip")
+	require.NoError(t, err)
+	require.Equal(t, TrailingSlashStrip, policy)
+
+	policy, err = ParseTrailingSlash("as-is")
+	require.NoError(t, err)
+	require.Equal(t, TrailingSlashAsIs, policy)
+
+	_, err = ParseTrailingSlash("foo")
+	require.Error(t, err)
+}
+
+func TestFileServerPrecompressed(t *testing.T) {
+	server := FileServer{WorkingDir: testDir(t, map[string]string{
+		"app.js":    "plain",
+		"app.js.br": "brotli",
+		"app.js.gz": "gzip",
+		"style.css": "plain css",
+	})}
+
+	rec := serveFileServer(server, "/app.js", "gzip, deflate, br")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "br", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	require.Equal(t, "text/javascript; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.Equal(t, "brotli", rec.Body.String())
+
+	rec = serveFileServer(server, "/app.js", "gzip;q=1.0, br;q=0")
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, []string{"Accept-Encoding"}, rec.Header()["Vary"])
+	require.Equal(t, "gzip", rec.Body.String())
+
+	rec = serveFileServer(server, "/app.js", "")
+	require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	require.Equal(t, "plain", rec.Body.String())
+
+	rec = serveFileServer(server, "/style.css", "br")
+	require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "", rec.Header().Get("Vary"))
+	require.Equal(t, "plain css", rec.Body.String())
+}
+
+func TestAddVary(t *testing.T) {
+	header := http.Header{}
+	addVary(header, "Accept-Encoding")
+	addVary(header, "accept-encoding")
+	require.Equal(t, []string{"Accept-Encoding"}, header["Vary"])
+
+	header = http.Header{"Vary": []string{"Origin, Accept-Encoding"}}
+	addVary(header, "Accept-Encoding")
+	require.Equal(t, []string{"Origin, Accept-Encoding"}, header["Vary"])
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		header   string
+		encoding string
+		accepted bool
+	}{
+		{"gzip, br", "br", true},
+		{"gzip", "br", false},
+		{"br;q=0", "br", false},
+		{"*", "gzip", true},
+		{"*, gzip;q=0", "gzip", false},
+		{"gzip;q=0, *", "gzip", false},
+		{"", "gzip", false},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", c.header)
+		require.Equal(t, c.accepted, acceptsEncoding(req, c.encoding), c.header)
+	}
+}
+
+func TestFileServerETag(t *testing.T) {
+	server := FileServer{WorkingDir: testDir(t, map[string]string{"a.txt": "hello"})}
+	etag := `"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`
+
+	rec := serveFileServer(server, "/a.txt", "")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, etag, rec.Header().Get("ETag"))
+
+	rec = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/a.txt", nil)
+	req.Header.Set("If-None-Match", etag)
+	server.Handle(rec, req)
+	require.Equal(t, 304, rec.Code)
+	require.Equal(t, "", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/a.txt", nil)
+	req.Header.Set("If-None-Match", `"outdated"`)
+	server.Handle(rec, req)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "hello", rec.Body.String())
+}
+
+func TestResolveFileBlocksHiddenAndRuleFiles(t *testing.T) {
+	root := testDir(t, map[string]string{
+		"_redirects":               "/a /b",
+		"_headers":                 "/a\n  X-A: b",
+		".env":                     "SECRET=1",
+		".git/config":              "[core]",
+		"docs/.secret.json":        "{}",
+		".well-known/security.txt": "Contact: me",
+		"a.txt":                    "a",
+	})
+
+	for _, p := range []string{"/_redirects", "/_HEADERS", "/.env", "/.git/config", "/docs/.secret.json", "/docs/../.env"} {
+		_, _, ok := resolveFile(root, p)
+		require.False(t, ok, p)
+	}
+	for _, p := range []string{"/a.txt", "/.well-known/security.txt"} {
+		_, _, ok := resolveFile(root, p)
+		require.True(t, ok, p)
+	}
+}
+
+func TestResolveFileTraversal(t *testing.T) {
+	outside := testDir(t, map[string]string{"secret.txt": "secret"})
+	root := testDir(t, map[string]string{"a.txt": "a"})
+	rel, err := filepath.Rel(root, filepath.Join(outside, "secret.txt"))
+	require.NoError(t, err)
+
+	_, _, ok := resolveFile(root, "/"+filepath.ToSlash(rel))
+	require.False(t, ok)
+
+	for _, p := range []string{"/../../a.txt", "/x/../a.txt", "/x/..", "/x\\..\\a.txt"} {
+		_, _, ok = resolveFile(root, p)
+		require.False(t, ok, p)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	require.Equal(t, "/", cleanPath(""))
+	require.Equal(t, "/", cleanPath("/"))
+	require.Equal(t, "/admin/a.html", cleanPath("//admin/./a.html"))
+	require.Equal(t, "/admin/", cleanPath("/admin//"))
+	require.Equal(t, "/admin", cleanPath("admin"))
+}
+
+func TestResolveFileSymlinks(t *testing.T) {
+	outside := testDir(t, map[string]string{"secret.txt": "secret"})
+	root := testDir(t, map[string]string{"a.txt": "a", ".env": "SECRET=1"})
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret.txt")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "outside")))
+	require.NoError(t, os.Symlink(filepath.Join(root, ".env"), filepath.Join(root, "env.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "a.txt.br")))
+
+	for _, p := range []string{"/secret.txt", "/outside/secret.txt", "/env.txt"} {
+		_, _, ok := resolveFile(root, p)
+		require.False(t, ok, p)
+	}
+	_, _, ok := resolveFile(root, "/b.txt")
+	require.True(t, ok)
+
+	rec := serveFileServer(FileServer{WorkingDir: root}, "/a.txt", "br")
+	require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "a", rec.Body.String())
+}
+
+func TestFileServerDotDot(t *testing.T) {
+	server := testServer(t, Config{}, map[string]string{"404.html": "not found"})
+	require.Equal(t, 400, serve(server, "GET", "/x/../404.html").Code)
+	require.Equal(t, 200, serve(server, "GET", "/./404.html").Code)
+}
+
+func serveFileServer(server FileServer, path string, acceptEncoding string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	server.Handle(rec, req)
+	return rec
+}
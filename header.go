@@ -11,54 +11,189 @@ import (
 
 	"crypto/subtle"
 
-	"github.com/julienschmidt/httprouter"
+	"path/filepath"
+
+	"os"
+
+	"net"
 )
 
 var (
 	commentLine  = regexp.MustCompile(`^\s*#`)
 	comment      = regexp.MustCompile("#.+")
 	leadingSpace = regexp.MustCompile(`^\s+`)
-	realm        = "Please enter your username and password for this site"
+	defaultRealm = "Please enter your username and password for this site"
 )
 
+// listHeaders are headers whose value is a comma-separated list.
+// When multiple paths match a request, their values are appended in the order of the _headers file.
+// Other headers are single-valued, a later path overrides the value of an earlier path.
+var listHeaders = map[string]bool{
+	"Link":                          true,
+	"Vary":                          true,
+	"Access-Control-Allow-Headers":  true,
+	"Access-Control-Allow-Methods":  true,
+	"Access-Control-Expose-Headers": true,
+	"Timing-Allow-Origin":           true,
+	"Permissions-Policy":            true,
+}
+
 // Header contains routes defined in _header file.
 type Header struct {
-	router *httprouter.Router
+	path *path
+	// CaseSensitive disables Netlify's case-insensitive path matching
+	CaseSensitive bool
+	// Policy decides which responses get the headers
+	Policy HeaderPolicy
+	// TrustedProxies are networks of reverse proxies whose X-Forwarded-For is trusted by IP-Allow and IP-Deny
+	TrustedProxies []*net.IPNet
+	// corsHeaders are headers of the same file with a CORS policy
+	corsHeaders []*Header
+}
+
+// HeaderMatch decides which path of a rewritten request is used to match _headers paths
+type HeaderMatch int
+
+const (
+	// HeaderMatchBoth applies headers of both the original path and the rewrite destination.
+	// Headers of the destination override single-valued headers of the original path.
+	HeaderMatchBoth HeaderMatch = iota
+	// HeaderMatchOriginal applies headers of the original path only
+	HeaderMatchOriginal
+	// HeaderMatchRewritten applies headers of the rewrite destination only, like Netlify
+	HeaderMatchRewritten
+)
+
+// ParseHeaderMatch returns the HeaderMatch of given name: "both", "original" or "rewritten"
+func ParseHeaderMatch(name string) (HeaderMatch, error) {
+	switch name {
+	case "both", "":
+		return HeaderMatchBoth, nil
+	case "original":
+		return HeaderMatchOriginal, nil
+	case "rewritten":
+		return HeaderMatchRewritten, nil
+	}
+	return HeaderMatchBoth, fmt.Errorf("Invalid header match policy: %s", name)
+}
+
+// HeaderPolicy decides which responses get headers defined in _headers.
+// Basic-Auth of the original path is always enforced regardless of the policy.
+type HeaderPolicy struct {
+	// Match decides which path of a rewritten request is used
+	Match HeaderMatch
+	// SkipRedirects doesn't add headers to 3xx responses
+	SkipRedirects bool
+	// SkipProxy doesn't add headers to proxied responses
+	SkipProxy bool
+}
+
+// applies returns true if headers should be added to the response.
+// original is true if the headers are matched with the original path of the request.
+func (policy HeaderPolicy) applies(w http.ResponseWriter, original bool) bool {
+	hw, ok := w.(*hookWriter)
+	if !ok {
+		return true
+	}
+	if policy.SkipRedirects && hw.status >= 300 && hw.status < 400 {
+		return false
+	}
+	if policy.SkipProxy && hw.proxied {
+		return false
+	}
+	if original && hw.rewritten && policy.Match == HeaderMatchRewritten {
+		return false
+	}
+	return true
 }
 
 func (header *Header) Match(r *http.Request) bool {
-	handle, _, _ := header.router.Lookup(r.Method, r.URL.Path)
-	return handle != nil
+	_, ok := header.lookup(r)
+	return ok
+}
+
+// lookup returns captured params if the request is a match to the path.
+// Paths match requests of any method, so HEAD, OPTIONS and proxied requests get the same headers and auth.
+func (header *Header) lookup(r *http.Request) (map[string]string, bool) {
+	return header.path.pattern.match(r.URL.Path, header.CaseSensitive)
 }
 
 // Handle checks if the router should process the given request.
 // It's a noop if the router should not process the request.
 // Returns error if the response is finalized and we shouldn't return anything more.
 func (header *Header) Handle(w http.ResponseWriter, r *http.Request) bool {
-	if !header.Match(r) {
+	params, ok := header.lookup(r)
+	if !ok {
 		return true
 	}
-	handle, params, _ := header.router.Lookup("GET", r.URL.Path)
-	if handle != nil {
-		handle(w, r, params)
 
-		// if there's an authentication error. stop the handler chain
-		if w.Header().Get("WWW-Authenticate") != "" {
+	// headers are added right before the response is written, when we know how it's generated
+	original := !isRewritten(r)
+	onWriteHeader(w, func(h http.Header) {
+		if header.Policy.applies(w, original) {
+			header.path.setHeaders(h, r, params)
+		}
+	})
+	// remove headers after all headers are merged, including headers set by the server or a proxied response
+	if len(header.path.Unsets) > 0 {
+		onWriteHeaderLast(w, func(h http.Header) {
+			if header.Policy.applies(w, original) {
+				header.path.unsetHeaders(h)
+			}
+		})
+	}
+
+	// network restrictions are checked before credentials
+	if !header.path.allowsIP(clientIP(r, header.TrustedProxies)) {
+		w.WriteHeader(403)
+		w.Write([]byte("Forbidden.\n"))
+		return false
+	}
+
+	if cors := header.path.CORS; cors != nil {
+		// preflight requests never carry credentials, so they are answered before auth,
+		// and they are never sent to a proxied server
+		if isPreflight(r) {
+			cors.preflight(w, r)
 			return false
 		}
+		onWriteHeader(w, func(h http.Header) {
+			cors.setHeaders(h, r)
+		})
 	}
-	return true
+
+	// preflight requests never carry credentials, so auth is skipped if a later path answers them
+	if isPreflight(r) && header.answersPreflight(r) {
+		return true
+	}
+
+	// stop the handler chain if the request is not authorized, the 401 response is sent already
+	return header.path.Handler(w, r, params)
+}
+
+// answersPreflight returns true if any path with a CORS policy matches the request
+func (header *Header) answersPreflight(r *http.Request) bool {
+	for _, h := range header.corsHeaders {
+		if _, ok := h.lookup(r); ok {
+			return true
+		}
+	}
+	return false
 }
 
 // NewHeaders returns an list of HeaderRouters from given rules.
 // Every path will creates a HeaderRouter
 func NewHeaders(config []byte) ([]middleware, error) {
+	return newHeaders("", config)
+}
+
+// newHeaders works like NewHeaders, files are resolved against given directory
+func newHeaders(directory string, config []byte) ([]middleware, error) {
 	headers := make([]middleware, 0)
 
 	lines := bytes.Split(config, []byte("\n"))
 
 	currentPath := &path{}
-	header := &Header{router: httprouter.New()}
 	for _, line := range lines {
 		// skip comment line
 		if commentLine.Match(line) {
@@ -74,20 +209,25 @@ func NewHeaders(config []byte) ([]middleware, error) {
 			// we alread have a path?
 			if currentPath.Path != "" {
 				// we're waiting for its header?
-				if len(currentPath.Headers) == 0 {
+				if currentPath.isEmpty() {
 					return nil, fmt.Errorf("Expect header but got a path: %s", line)
 				}
+				if err := currentPath.validate(); err != nil {
+					return nil, err
+				}
 				// the path is complete, push to paths
-				header.router.GET(currentPath.Path, currentPath.Handler)
-				headers = append(headers, header)
-				header = &Header{router: httprouter.New()}
+				headers = append(headers, &Header{path: currentPath})
 			}
 			// get a new path
-			p := parsePath(line)
+			p, err := parsePath(line)
+			if err != nil {
+				return nil, err
+			}
 			// skip empty line
 			if p == nil {
 				continue
 			}
+			p.wd = directory
 			currentPath = p
 			continue
 		}
@@ -112,14 +252,25 @@ func NewHeaders(config []byte) ([]middleware, error) {
 	}
 
 	if currentPath.Path != "" {
-		if len(currentPath.Headers) > 0 || len(currentPath.Auths) > 0 {
-			header.router.GET(currentPath.Path, currentPath.Handler)
-			headers = append(headers, header)
+		if err := currentPath.validate(); err != nil {
+			return nil, err
+		}
+		if !currentPath.isEmpty() {
+			headers = append(headers, &Header{path: currentPath})
 		} else {
 			return nil, fmt.Errorf("unclosed path")
 		}
 	}
 
+	var corsHeaders []*Header
+	for _, header := range headers {
+		if header.(*Header).path.CORS != nil {
+			corsHeaders = append(corsHeaders, header.(*Header))
+		}
+	}
+	for _, header := range headers {
+		header.(*Header).corsHeaders = corsHeaders
+	}
 	return headers, nil
 }
 
@@ -127,53 +278,264 @@ type path struct {
 	Path    string
 	Headers map[string][]string
 	Auths   []auth
+	// Unsets are headers to be removed from the response
+	Unsets []string
+	// basicAuth is true if there's a Basic-Auth line
+	basicAuth bool
+	// Realm is the realm of Basic-Auth, defaultRealm is used if it's empty
+	Realm string
+	// UnauthorizedPage is the site file served as the body of 401 responses
+	UnauthorizedPage string
+	// JWT validates bearer tokens if the path has a JWT-Auth line
+	JWT *jwtAuth
+	// IPAllow are networks allowed to access the path, everyone is allowed if it's empty
+	IPAllow []*net.IPNet
+	// IPDeny are networks denied to access the path, it takes precedence over IPAllow
+	IPDeny []*net.IPNet
+	// CORS answers preflight requests and adds CORS headers if the path has a CORS line
+	CORS    *corsPolicy
+	wd      string
+	pattern *pattern
 }
 
 type auth struct {
 	Username string
+	// Password is a plaintext password or a hash, see checkPassword
 	Password string
 }
 
-// Handler is a httprouter handler which is used for adding headers to response
-func (path *path) Handler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// if basic auth is required
-	if len(path.Auths) > 0 {
-		user, pass, ok := r.BasicAuth()
-		login := false
-		if ok {
-			for _, auth := range path.Auths {
-				if subtle.ConstantTimeCompare([]byte(user), []byte(auth.Username)) == 1 && subtle.ConstantTimeCompare([]byte(pass), []byte(auth.Password)) == 1 {
-					login = true
-					break
-				}
+// Handler checks basic auth and JWT auth of the path.
+// It returns false after replying with 401 or 403 if the request is not authorized.
+func (path *path) Handler(w http.ResponseWriter, r *http.Request, params map[string]string) bool {
+	if path.JWT != nil {
+		switch path.JWT.authorize(r) {
+		case 401:
+			// the default realm asks for a username and password, which doesn't fit a token
+			challenge := "Bearer"
+			if path.Realm != "" {
+				challenge += ` realm="` + path.Realm + `"`
 			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			path.unauthorized(w, r)
+			return false
+		case 403:
+			w.WriteHeader(403)
+			w.Write([]byte("Forbidden.\n"))
+			return false
 		}
-		if !login {
-			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
-			w.WriteHeader(401)
-			w.Write([]byte("Unauthorized.\n"))
+	}
+
+	// if basic auth is not required
+	if len(path.Auths) == 0 {
+		return true
+	}
+
+	realm := path.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if ok {
+		for _, auth := range path.Auths {
+			if subtle.ConstantTimeCompare([]byte(user), []byte(auth.Username)) == 1 && checkPassword(auth.Password, pass) {
+				return true
+			}
 		}
 	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+	path.unauthorized(w, r)
+	return false
+}
+
+// unauthorized replies with 401 and the page of Basic-Auth-Page if there is one
+func (path *path) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if path.UnauthorizedPage != "" {
+		if file, _, ok := resolveFile(path.wd, path.UnauthorizedPage); ok {
+			// the page of a protected path may be cached, the 401 must not
+			w.Header().Set("Cache-Control", "no-store")
+			serveFileWithStatus(w, r, file, 401)
+			return
+		}
+	}
+	w.WriteHeader(401)
+	w.Write([]byte("Unauthorized.\n"))
+}
+
+// setHeaders adds headers of the path to the response header
+func (path *path) setHeaders(h http.Header, r *http.Request, params map[string]string) {
 	// joining multiple header
 	for k, header := range path.Headers {
-		w.Header().Set(k, strings.Join(header, ", "))
+		value, ok := path.interpolate(strings.Join(header, ", "), r, params)
+		if !ok {
+			continue
+		}
+		mergeHeader(h, k, value)
+	}
+}
+
+// mergeHeader appends the value to a list header, or overrides a single-valued header.
+// Items which are already in the list are not appended again.
+func mergeHeader(h http.Header, key string, value string) {
+	key = http.CanonicalHeaderKey(key)
+	existing := h.Get(key)
+	if !listHeaders[key] || existing == "" {
+		h.Set(key, value)
+		return
+	}
+
+	items := splitList(existing)
+	for _, item := range splitList(value) {
+		found := false
+		for _, e := range items {
+			if e == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			existing += ", " + item
+			items = append(items, item)
+		}
+	}
+	h.Set(key, existing)
+}
+
+// splitList splits a comma separated header value into trimmed items.
+// Commas in quoted strings and in `<...>` are kept, such as `</a,b>; title="a, b"` of a Link header.
+func splitList(value string) []string {
+	var items []string
+	start, quoted, angled := 0, false, false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '<':
+			angled = true
+		case !quoted && c == '>':
+			angled = false
+		case !quoted && !angled && c == ',':
+			if item := strings.TrimSpace(value[start:i]); item != "" {
+				items = append(items, item)
+			}
+			start = i + 1
+		}
 	}
+	if item := strings.TrimSpace(value[start:]); item != "" {
+		items = append(items, item)
+	}
+	return items
+}
+
+// unsetHeaders removes headers which should be unset by the path
+func (path *path) unsetHeaders(h http.Header) {
+	for _, k := range path.Unsets {
+		h.Del(k)
+	}
+}
+
+// isEmpty returns true if there's nothing to do for the path
+func (path *path) isEmpty() bool {
+	return len(path.Headers) == 0 && len(path.Auths) == 0 && len(path.Unsets) == 0 && path.JWT == nil &&
+		len(path.IPAllow) == 0 && len(path.IPDeny) == 0 && path.CORS == nil
+}
+
+// allowsIP returns true if the client IP passes IP-Allow and IP-Deny of the path
+func (path *path) allowsIP(ip net.IP) bool {
+	if containsIP(path.IPDeny, ip) {
+		return false
+	}
+	return len(path.IPAllow) == 0 || containsIP(path.IPAllow, ip)
+}
+
+// validate returns an error if the path has Basic-Auth options without credentials
+func (path *path) validate() error {
+	if len(path.Auths) == 0 && path.JWT == nil && (path.Realm != "" || path.UnauthorizedPage != "") {
+		return fmt.Errorf("Basic-Auth-Realm or Basic-Auth-Page without credentials: %s", path.Path)
+	}
+	if len(path.Auths) > 0 && path.JWT != nil {
+		return fmt.Errorf("Basic-Auth and JWT-Auth can't be used on the same path: %s", path.Path)
+	}
+	return nil
+}
+
+// interpolate replaces placeholders and splat in the header value with values captured from the request path.
+// `:hash` is the content hash of the requested file, unless the path captures a `:hash` placeholder.
+// Returns false if the value references a content hash but there's no such file.
+func (path *path) interpolate(value string, r *http.Request, params map[string]string) (string, bool) {
+	ok := true
+	value = placeholderName.ReplaceAllStringFunc(value, func(v string) string {
+		if captured, found := params[v[1:]]; found {
+			return captured
+		}
+		if v == ":hash" {
+			hash := path.contentHash(r)
+			if hash == "" {
+				ok = false
+			}
+			return hash
+		}
+		return v
+	})
+	return value, ok
+}
+
+// contentHash returns the content hash of the file the request resolves to, or empty string if there's no such file
+func (path *path) contentHash(r *http.Request) string {
+	file, _, ok := resolveFile(path.wd, r.URL.Path)
+	if !ok {
+		return ""
+	}
+	hash, err := contentHashes.hash(file)
+	if err != nil {
+		return ""
+	}
+	return hash
 }
 
-func parsePath(line []byte) *path {
+func parsePath(line []byte) (*path, error) {
 	// remove inline comment
 	line = comment.ReplaceAll(line, []byte(""))
 	line = bytes.Trim(line, " \t")
 
 	if bytes.Compare(line, []byte("")) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	if bytes.HasSuffix(line, []byte("*")) {
 		line = []byte(string(line) + "splat") // lazy way to do clone + concat
 	}
 
-	return &path{Path: string(line), Headers: make(map[string][]string), Auths: make([]auth, 0)}
+	p, err := newPattern(string(line))
+	if err != nil {
+		return nil, err
+	}
+
+	return &path{Path: trimTrailingSlash(string(line)), Headers: make(map[string][]string), Auths: make([]auth, 0), pattern: p}, nil
+}
+
+// envVar matches a reference to an environment variable such as `${API_TOKEN}`
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces references to environment variables in a header value.
+// It returns an error if a variable is not set, so a missing secret never becomes an empty password.
+func expandEnv(value string) (string, error) {
+	var missing string
+	value = envVar.ReplaceAllStringFunc(value, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		v, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("Environment variable %s is not set", missing)
+	}
+	return value, nil
 }
 
 func parseHeader(line []byte, currentPath *path) (*path, error) {
@@ -185,21 +547,128 @@ func parseHeader(line []byte, currentPath *path) (*path, error) {
 		return nil, nil
 	}
 
+	// unset a header, e.g. `! X-Frame-Options`
+	if bytes.HasPrefix(line, []byte("!")) {
+		key := string(bytes.Trim(line[1:], " \t"))
+		if key == "" || strings.ContainsAny(key, ": \t") {
+			return nil, fmt.Errorf("Invalid header to unset: %s", line)
+		}
+		currentPath.Unsets = append(currentPath.Unsets, http.CanonicalHeaderKey(key))
+		return currentPath, nil
+	}
+
 	comps := bytes.Split(line, []byte(":"))
-	key := string(comps[0])
+	key := http.CanonicalHeaderKey(string(comps[0]))
 	value := strings.Trim(string(bytes.Join(comps[1:], []byte(":"))), " \t")
 
 	if key == "Basic-Auth" {
-		authPairs := strings.Split(value, " ")
-		if len(currentPath.Auths) > 0 {
+		if currentPath.basicAuth {
 			return nil, fmt.Errorf("Duplicated Basic-Auth line: %s", line)
 		}
-		for _, pair := range authPairs {
-			p := strings.Split(pair, ":")
-			username := p[0]
-			password := p[1]
-			currentPath.Auths = append(currentPath.Auths, auth{username, password})
+		currentPath.basicAuth = true
+		// credentials are split before expanding environment variables, so a secret may contain spaces
+		pairs := strings.Fields(value)
+		if len(pairs) == 0 {
+			return nil, fmt.Errorf("Empty Basic-Auth line: %s", line)
+		}
+		for _, pair := range pairs {
+			// only the first colon separates the username, the password may contain colons
+			p := strings.SplitN(pair, ":", 2)
+			if len(p) < 2 {
+				return nil, fmt.Errorf("Invalid Basic-Auth credentials, expect user:password: %s", line)
+			}
+			user, err := expandEnv(p[0])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %s", err, line)
+			}
+			password, err := expandEnv(p[1])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %s", err, line)
+			}
+			if user == "" || password == "" || strings.Contains(user, ":") {
+				return nil, fmt.Errorf("Invalid Basic-Auth credentials, expect user:password: %s", line)
+			}
+			if err := validatePassword(password); err != nil {
+				return nil, fmt.Errorf("%v for user %s: %s", err, user, currentPath.Path)
+			}
+			currentPath.Auths = append(currentPath.Auths, auth{user, password})
+		}
+		return currentPath, nil
+	}
+
+	value, err := expandEnv(value)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, line)
+	}
+
+	if key == "Basic-Auth-File" {
+		file := filepath.FromSlash(value)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(currentPath.wd, file)
+		}
+		auths, err := loadHtpasswd(file)
+		if err != nil {
+			return nil, err
+		}
+		// credentials should never be served
+		addPrivateFile(file)
+		currentPath.Auths = append(currentPath.Auths, auths...)
+		return currentPath, nil
+	}
+
+	if key == "Ip-Allow" || key == "Ip-Deny" {
+		networks, err := parseCIDRs(strings.Fields(strings.Replace(value, ",", " ", -1)))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %s", err, line)
+		}
+		if len(networks) == 0 {
+			return nil, fmt.Errorf("Empty IP list: %s", line)
+		}
+		if key == "Ip-Allow" {
+			currentPath.IPAllow = append(currentPath.IPAllow, networks...)
+		} else {
+			currentPath.IPDeny = append(currentPath.IPDeny, networks...)
+		}
+		return currentPath, nil
+	}
+
+	if key == "Cors" {
+		if currentPath.CORS != nil {
+			return nil, fmt.Errorf("Duplicated CORS line: %s", line)
+		}
+		cors, err := parseCORS(value)
+		if err != nil {
+			return nil, err
+		}
+		currentPath.CORS = cors
+		return currentPath, nil
+	}
+
+	if key == "Jwt-Auth" {
+		if currentPath.JWT != nil {
+			return nil, fmt.Errorf("Duplicated JWT-Auth line: %s", line)
+		}
+		jwtAuth, err := parseJWTAuth(value, currentPath.wd)
+		if err != nil {
+			return nil, err
+		}
+		currentPath.JWT = jwtAuth
+		return currentPath, nil
+	}
+
+	if key == "Basic-Auth-Realm" {
+		if value == "" || strings.ContainsAny(value, "\"\\") {
+			return nil, fmt.Errorf("Invalid Basic-Auth-Realm: %s", line)
+		}
+		currentPath.Realm = value
+		return currentPath, nil
+	}
+
+	if key == "Basic-Auth-Page" {
+		if _, _, ok := resolveFile(currentPath.wd, value); !ok {
+			return nil, fmt.Errorf("Basic-Auth-Page not found: %s", line)
 		}
+		currentPath.UnauthorizedPage = value
 		return currentPath, nil
 	}
 
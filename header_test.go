@@ -67,6 +67,11 @@ func TestParseUnclosedPath(t *testing.T) {
 	require.Nil(t, routers)
 }
 
+func TestParseHeaderInvalidPasswordHash(t *testing.T) {
+	_, err := NewHeaders([]byte("/*\n  Basic-Auth: foo:$5$rounds=5000"))
+	require.Error(t, err)
+}
+
 func TestParseHeaderWithEmptyLine(t *testing.T) {
 	config := `
 /foo
@@ -325,6 +330,346 @@ func TestPathBasicAuthAndHeader(t *testing.T) {
 	require.Equal(t, 401, res.Code)
 }
 
+func TestPathMatchingTrailingSlash(t *testing.T) {
+	config := `
+/foo
+	X-TEST-HEADER: bar
+/bar/
+	X-TEST-HEADER: baz
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.NoError(t, err)
+	req, _ := http.NewRequest("GET", "/foo/", nil)
+	require.True(t, headers[0].Match(req))
+	req, _ = http.NewRequest("GET", "/bar", nil)
+	require.True(t, headers[1].Match(req))
+
+	res := testHeader(headers[1], req)
+	require.Equal(t, "baz", res.Header().Get("X-TEST-HEADER"))
+}
+
+func TestPathMatchingCaseInsensitive(t *testing.T) {
+	config := `
+/Foo/*
+	X-TEST-HEADER: bar
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.NoError(t, err)
+	req, _ := http.NewRequest("GET", "/foo/BAR", nil)
+	require.True(t, headers[0].Match(req))
+
+	res := testHeader(headers[0], req)
+	require.Equal(t, "bar", res.Header().Get("X-TEST-HEADER"))
+
+	headers[0].(*Header).CaseSensitive = true
+	require.False(t, headers[0].Match(req))
+	req, _ = http.NewRequest("GET", "/Foo/BAR", nil)
+	require.True(t, headers[0].Match(req))
+}
+
+func TestHeaderContentHash(t *testing.T) {
+	config := `
+/*
+	X-Content-Hash: :hash
+	Link: </style.css?v=:hash>; rel=preload
+	`
+	headers, err := newHeaders(testDir(t, map[string]string{"a.txt": "hello"}), []byte(config))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/a.txt", nil)
+	res := testHeader(headers[0], req)
+	require.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", res.Header().Get("X-Content-Hash"))
+	require.Equal(t, "</style.css?v=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824>; rel=preload", res.Header().Get("Link"))
+
+	req, _ = http.NewRequest("GET", "/missing.txt", nil)
+	res = testHeader(headers[0], req)
+	require.Equal(t, "", res.Header().Get("X-Content-Hash"))
+}
+
+func TestPathMatchingWildcardInTheMiddle(t *testing.T) {
+	config := `
+/:lang/*/style.css
+	X-TEST-HEADER: bar
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.NoError(t, err)
+	req, _ := http.NewRequest("GET", "/en/themes/dark/style.css", nil)
+	require.True(t, headers[0].Match(req))
+	req, _ = http.NewRequest("GET", "/en/themes/dark/app.js", nil)
+	require.False(t, headers[0].Match(req))
+}
+
+func TestHeaderInterpolation(t *testing.T) {
+	config := `
+/:lang/*
+	Link: </:lang/style.css>; rel=preload; as=style
+	X-Splat: :splat
+	X-Port: http://localhost:8080/:unknown
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.NoError(t, err)
+	req, _ := http.NewRequest("GET", "/zh-TW/blog/hello", nil)
+	require.True(t, headers[0].Match(req))
+
+	res := testHeader(headers[0], req)
+	require.Equal(t, "</zh-TW/style.css>; rel=preload; as=style", res.Header().Get("Link"))
+	require.Equal(t, "blog/hello", res.Header().Get("X-Splat"))
+	require.Equal(t, "http://localhost:8080/:unknown", res.Header().Get("X-Port"))
+}
+
+func TestParseInvalidHeaderPath(t *testing.T) {
+	config := `
+/:id/:id
+	X-TEST-HEADER: bar
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.Error(t, err)
+	require.Nil(t, headers)
+}
+
+func TestMergeHeader(t *testing.T) {
+	h := http.Header{}
+	mergeHeader(h, "link", "</a.css>; rel=preload")
+	mergeHeader(h, "Link", "</b.css>; rel=preload, </a.css>; rel=preload")
+	require.Equal(t, "</a.css>; rel=preload, </b.css>; rel=preload", h.Get("Link"))
+
+	mergeHeader(h, "Cache-Control", "max-age=0")
+	mergeHeader(h, "cache-control", "max-age=3600")
+	require.Equal(t, []string{"max-age=3600"}, h["Cache-Control"])
+}
+
+func TestMergeHeaderQuotedComma(t *testing.T) {
+	h := http.Header{}
+	mergeHeader(h, "Link", `</a,b.css>; rel=preload; title="a, b"`)
+	mergeHeader(h, "Link", `</a,b.css>; rel=preload; title="a, b", </c.css>; rel=preload; title="\"c, d\""`)
+	require.Equal(t, `</a,b.css>; rel=preload; title="a, b", </c.css>; rel=preload; title="\"c, d\""`, h.Get("Link"))
+
+	require.Equal(t, []string{`</a,b>; title="a, b"`, "b"}, splitList(` </a,b>; title="a, b" ,, b`))
+}
+
+func TestMergeOverlappingPaths(t *testing.T) {
+	config := `
+/*
+	Cache-Control: max-age=0
+	Link: </style.css>; rel=preload
+	X-Frame-Options: DENY
+/blog/*
+	Cache-Control: max-age=3600
+	Link: </blog.css>; rel=preload
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/blog/hello", nil)
+	rec := httptest.NewRecorder()
+	for _, header := range headers {
+		require.True(t, header.Handle(rec, req))
+	}
+	require.Equal(t, "max-age=3600", rec.Header().Get("Cache-Control"))
+	require.Equal(t, "</style.css>; rel=preload, </blog.css>; rel=preload", rec.Header().Get("Link"))
+	require.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"))
+
+	req, _ = http.NewRequest("GET", "/about", nil)
+	rec = httptest.NewRecorder()
+	for _, header := range headers {
+		require.True(t, header.Handle(rec, req))
+	}
+	require.Equal(t, "max-age=0", rec.Header().Get("Cache-Control"))
+	require.Equal(t, "</style.css>; rel=preload", rec.Header().Get("Link"))
+}
+
+func TestParseUnsetHeader(t *testing.T) {
+	config := `
+/embed/*
+	! X-Frame-Options
+	!x-powered-by
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.NoError(t, err)
+	require.Equal(t, []string{"X-Frame-Options", "X-Powered-By"}, headers[0].(*Header).path.Unsets)
+
+	req, _ := http.NewRequest("GET", "/embed/widget", nil)
+	rec := httptest.NewRecorder()
+	rec.Header().Set("X-Frame-Options", "DENY")
+	headers[0].Handle(rec, req)
+	require.Equal(t, "", rec.Header().Get("X-Frame-Options"))
+}
+
+func TestParseInvalidUnsetHeader(t *testing.T) {
+	config := `
+/embed/*
+	! X-Frame-Options: DENY
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.Error(t, err)
+	require.Nil(t, headers)
+}
+
+func TestParseHeaderMatch(t *testing.T) {
+	match, err := ParseHeaderMatch("both")
+	require.NoError(t, err)
+	require.Equal(t, HeaderMatchBoth, match)
+
+	match, err = ParseHeaderMatch("original")
+	require.NoError(t, err)
+	require.Equal(t, HeaderMatchOriginal, match)
+
+	match, err = ParseHeaderMatch("rewritten")
+	require.NoError(t, err)
+	require.Equal(t, HeaderMatchRewritten, match)
+
+	_, err = ParseHeaderMatch("foo")
+	require.Error(t, err)
+}
+
+func TestPathHashedBasicAuth(t *testing.T) {
+	config := `
+/login
+	Basic-Auth: foo:$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0 bar:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.NoError(t, err)
+	req, _ := http.NewRequest("GET", "/login", nil)
+
+	res := testHeaderAuth(headers[0], req, "foo", "myPassword")
+	require.Equal(t, 200, res.Code)
+
+	res = testHeaderAuth(headers[0], req, "bar", "Hello world!")
+	require.Equal(t, 200, res.Code)
+
+	res = testHeaderAuth(headers[0], req, "foo", "$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0")
+	require.Equal(t, 401, res.Code)
+}
+
+func TestPathBasicAuthFile(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"auth/users.htpasswd": "alice:$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0\n",
+	})
+	config := `
+/admin/*
+	Basic-Auth-File: auth/users.htpasswd
+	Basic-Auth: bob:pass
+	`
+	headers, err := newHeaders(dir, []byte(config))
+	require.NoError(t, err)
+	req, _ := http.NewRequest("GET", "/admin/", nil)
+
+	res := testHeaderAuth(headers[0], req, "alice", "myPassword")
+	require.Equal(t, 200, res.Code)
+
+	res = testHeaderAuth(headers[0], req, "bob", "pass")
+	require.Equal(t, 200, res.Code)
+
+	res = testHeaderAuth(headers[0], req, "alice", "pass")
+	require.Equal(t, 401, res.Code)
+
+	_, err = newHeaders(dir, []byte("/admin/*\n  Basic-Auth-File: missing.htpasswd"))
+	require.Error(t, err)
+}
+
+func TestHeaderEnvExpansion(t *testing.T) {
+	t.Setenv("SITEX_TEST_USER", "staging")
+	t.Setenv("SITEX_TEST_PASS", "s3cret")
+	t.Setenv("SITEX_TEST_TOKEN", "abc")
+	config := `
+/*
+	Basic-Auth: ${SITEX_TEST_USER}:${SITEX_TEST_PASS}
+	X-Token: Bearer ${SITEX_TEST_TOKEN}
+	X-Price: $5
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.NoError(t, err)
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	res := testHeaderAuth(headers[0], req, "staging", "s3cret")
+	require.Equal(t, 200, res.Code)
+	require.Equal(t, "Bearer abc", res.Header().Get("X-Token"))
+	require.Equal(t, "$5", res.Header().Get("X-Price"))
+
+	res = testHeaderAuth(headers[0], req, "${SITEX_TEST_USER}", "${SITEX_TEST_PASS}")
+	require.Equal(t, 401, res.Code)
+
+	_, err = NewHeaders([]byte("/*\n  Basic-Auth: user:${SITEX_TEST_MISSING}"))
+	require.EqualError(t, err, "Environment variable SITEX_TEST_MISSING is not set: Basic-Auth: user:${SITEX_TEST_MISSING}")
+}
+
+func TestHeaderEnvExpansionSecretWithSpace(t *testing.T) {
+	t.Setenv("SITEX_TEST_PASS", "correct horse")
+	t.Setenv("SITEX_TEST_USER", "a:b")
+	headers, err := NewHeaders([]byte("/*\n  Basic-Auth: staging:${SITEX_TEST_PASS} other:pass"))
+	require.NoError(t, err)
+	require.Equal(t, []auth{{"staging", "correct horse"}, {"other", "pass"}}, headers[0].(*Header).path.Auths)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	require.Equal(t, 200, testHeaderAuth(headers[0], req, "staging", "correct horse").Code)
+	require.Equal(t, 401, testHeaderAuth(headers[0], req, "staging", "correct").Code)
+
+	_, err = NewHeaders([]byte("/*\n  Basic-Auth: ${SITEX_TEST_USER}:pass"))
+	require.Error(t, err)
+}
+
+func TestPathBasicAuthParsing(t *testing.T) {
+	config := `
+/*
+	Basic-Auth: foo:bar:baz   qux:a:b
+	`
+	headers, err := NewHeaders([]byte(config))
+	require.NoError(t, err)
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	res := testHeaderAuth(headers[0], req, "foo", "bar:baz")
+	require.Equal(t, 200, res.Code)
+	res = testHeaderAuth(headers[0], req, "qux", "a:b")
+	require.Equal(t, 200, res.Code)
+	res = testHeaderAuth(headers[0], req, "foo", "bar")
+	require.Equal(t, 401, res.Code)
+
+	for _, invalid := range []string{
+		"/*\n  Basic-Auth: user",
+		"/*\n  Basic-Auth: user:",
+		"/*\n  Basic-Auth: :pass",
+		"/*\n  Basic-Auth:",
+		"/*\n  Basic-Auth-Realm: \"quoted\"\n  Basic-Auth: user:pass",
+		"/*\n  Basic-Auth-Realm: Staging",
+	} {
+		_, err = NewHeaders([]byte(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestPathBasicAuthRealm(t *testing.T) {
+	headers, err := NewHeaders([]byte("/staging/*\n  Basic-Auth: user:pass\n  Basic-Auth-Realm: Staging site\n/*\n  Basic-Auth: user:pass"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/staging/", nil)
+	res := testHeaderAuth(headers[0], req, "user", "wrong")
+	require.Equal(t, 401, res.Code)
+	require.Equal(t, `Basic realm="Staging site"`, res.Header().Get("WWW-Authenticate"))
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	res = testHeaderAuth(headers[1], req, "user", "wrong")
+	require.Equal(t, `Basic realm="`+defaultRealm+`"`, res.Header().Get("WWW-Authenticate"))
+}
+
+func TestPathBasicAuthPage(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"401.html": "<h1>Please log in</h1>",
+	})
+	headers, err := newHeaders(dir, []byte("/*\n  Basic-Auth: user:pass\n  Basic-Auth-Page: /401.html"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := testHeaderAuth(headers[0], req, "user", "wrong")
+	require.Equal(t, 401, res.Code)
+	require.Equal(t, "<h1>Please log in</h1>", res.Body.String())
+	require.Equal(t, "text/html; charset=utf-8", res.Header().Get("Content-Type"))
+	require.Equal(t, "no-store", res.Header().Get("Cache-Control"))
+	require.NotEmpty(t, res.Header().Get("WWW-Authenticate"))
+
+	_, err = newHeaders(dir, []byte("/*\n  Basic-Auth: user:pass\n  Basic-Auth-Page: /missing.html"))
+	require.Error(t, err)
+}
+
 func testHeader(mw middleware, req *http.Request) *httptest.ResponseRecorder {
 	rec := httptest.NewRecorder()
 	mw.Handle(rec, req)
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := parseCIDRs([]string{"10.0.0.0/8", " 192.168.1.5 ", "", "2001:db8::/32", "::1"})
+	require.NoError(t, err)
+	require.Len(t, networks, 4)
+
+	require.True(t, containsIP(networks, net.ParseIP("10.1.2.3")))
+	require.True(t, containsIP(networks, net.ParseIP("192.168.1.5")))
+	require.False(t, containsIP(networks, net.ParseIP("192.168.1.6")))
+	require.True(t, containsIP(networks, net.ParseIP("2001:db8::1")))
+	require.True(t, containsIP(networks, net.ParseIP("::1")))
+	require.False(t, containsIP(networks, nil))
+
+	_, err = parseCIDRs([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+	_, err = parseCIDRs([]string{"office"})
+	require.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("X-Forwarded-For", "192.168.1.5")
+	// X-Forwarded-For of an untrusted client is ignored
+	require.Equal(t, "203.0.113.7", clientIP(req, proxies).String())
+	require.Equal(t, "203.0.113.7", clientIP(req, nil).String())
+
+	req.RemoteAddr = "10.0.0.1:1234"
+	require.Equal(t, "192.168.1.5", clientIP(req, proxies).String())
+	require.Equal(t, "10.0.0.1", clientIP(req, nil).String())
+
+	// the rightmost untrusted address is the client, anything before it may be spoofed
+	req.Header.Set("X-Forwarded-For", "192.168.1.5, 203.0.113.7, 10.0.0.2")
+	require.Equal(t, "203.0.113.7", clientIP(req, proxies).String())
+
+	req.Header.Set("X-Forwarded-For", "192.168.1.5, garbage")
+	require.Equal(t, "10.0.0.1", clientIP(req, proxies).String())
+
+	req.Header.Del("X-Forwarded-For")
+	require.Equal(t, "10.0.0.1", clientIP(req, proxies).String())
+}
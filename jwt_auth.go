@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtLeeway tolerates clock skew between SiteX and the identity provider
+const jwtLeeway = 30 * time.Second
+
+// jwtAuth validates JSON Web Tokens of a `JWT-Auth` line in _headers, such as
+// `JWT-Auth: jwks=auth/jwks.json aud=docs cookie=token claim=role=admin`.
+type jwtAuth struct {
+	// keys are public keys from a JWKS file, by key ID
+	keys map[string]interface{}
+	// secret is the key of HMAC signed tokens
+	secret []byte
+	// Audience is required in the `aud` claim if it's not empty
+	Audience string
+	// Issuer is required in the `iss` claim if it's not empty
+	Issuer string
+	// Cookie is the name of a cookie which contains the token, if there's no Authorization header
+	Cookie string
+	// Claims are required claims and their values
+	Claims []requiredClaim
+	parser *jwt.Parser
+}
+
+type requiredClaim struct {
+	Name  string
+	Value string
+}
+
+// parseJWTAuth returns the JWT validation of given `JWT-Auth` options.
+// The JWKS file is resolved against wd unless it's absolute.
+func parseJWTAuth(value string, wd string) (*jwtAuth, error) {
+	a := &jwtAuth{}
+	for _, option := range strings.Fields(value) {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) < 2 || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid JWT-Auth option: %s", option)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "jwks":
+			file := filepath.FromSlash(kv[1])
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(wd, file)
+			}
+			keys, err := loadJWKS(file)
+			if err != nil {
+				return nil, err
+			}
+			// keys should never be served
+			addPrivateFile(file)
+			a.keys = keys
+		case "secret":
+			a.secret = []byte(kv[1])
+		case "aud":
+			a.Audience = kv[1]
+		case "iss":
+			a.Issuer = kv[1]
+		case "cookie":
+			a.Cookie = kv[1]
+		case "claim":
+			claim := strings.SplitN(kv[1], "=", 2)
+			if len(claim) < 2 || claim[0] == "" {
+				return nil, fmt.Errorf("Invalid JWT-Auth claim, expect claim=name=value: %s", option)
+			}
+			a.Claims = append(a.Claims, requiredClaim{claim[0], claim[1]})
+		default:
+			return nil, fmt.Errorf("Invalid JWT-Auth option: %s", option)
+		}
+	}
+	if a.keys == nil && a.secret == nil {
+		return nil, fmt.Errorf("JWT-Auth requires jwks or secret: %s", value)
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+	}
+	if a.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.Issuer))
+	}
+	a.parser = jwt.NewParser(options...)
+	return a, nil
+}
+
+// authorize validates the token of the request.
+// It returns 401 if the token is missing or invalid, or 403 if the token lacks the audience or claims.
+func (a *jwtAuth) authorize(r *http.Request) int {
+	raw := bearerToken(r)
+	if raw == "" && a.Cookie != "" {
+		if cookie, err := r.Cookie(a.Cookie); err == nil {
+			raw = cookie.Value
+		}
+	}
+	if raw == "" {
+		return 401
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(raw, claims, a.key); err != nil {
+		return 401
+	}
+
+	if a.Audience != "" {
+		audience, err := claims.GetAudience()
+		if err != nil || !contains(audience, a.Audience) {
+			return 403
+		}
+	}
+	for _, required := range a.Claims {
+		if !claimContains(claims[required.Name], required.Value) {
+			return 403
+		}
+	}
+	return 200
+}
+
+// key returns the key to verify the token
+func (a *jwtAuth) key(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if a.secret == nil {
+			return nil, fmt.Errorf("No secret for %s", token.Method.Alg())
+		}
+		return a.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	// a token without key ID can be verified if there's only one key
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown key ID: %s", kid)
+}
+
+// bearerToken returns the token in the Authorization header
+func bearerToken(r *http.Request) string {
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Bearer") {
+		return ""
+	}
+	return fields[1]
+}
+
+// claimContains returns true if the claim is the value, or a list containing the value
+func claimContains(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case string:
+		return v == value
+	case []interface{}:
+		for _, item := range v {
+			if claimContains(item, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(claim) == value
+}
+
+// loadJWKS returns public keys of a JSON Web Key Set file by key ID.
+// RSA and EC keys are supported, symmetric keys should be given as `secret` instead.
+func loadJWKS(file string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("Invalid JWKS %s: %v", file, err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 {
+				return nil, fmt.Errorf("Invalid RSA key %s in %s", k.Kid, file)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("Unsupported curve %s of key %s in %s", k.Crv, k.Kid, file)
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("Invalid EC key %s in %s", k.Kid, file)
+			}
+			key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(key.X, key.Y) {
+				return nil, fmt.Errorf("Invalid EC key %s in %s", k.Kid, file)
+			}
+			keys[k.Kid] = key
+		default:
+			return nil, fmt.Errorf("Unsupported key type %s of key %s in %s", k.Kty, k.Kid, file)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No signing key in %s", file)
+	}
+	return keys, nil
+}
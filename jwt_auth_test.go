@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTAuthWithJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	dir := testDir(t, map[string]string{"auth/jwks.json": testJWKS(t, rsaKey, ecKey)})
+
+	a, err := parseJWTAuth("jwks=auth/jwks.json aud=docs iss=https://id.example.com claim=groups=staff", dir)
+	require.NoError(t, err)
+
+	valid := jwt.MapClaims{
+		"aud":    "docs",
+		"iss":    "https://id.example.com",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": []string{"dev", "staff"},
+	}
+	require.Equal(t, 200, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, valid))))
+	require.Equal(t, 200, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodES256, "ec", ecKey, valid))))
+
+	// missing or invalid tokens
+	req, _ := http.NewRequest("GET", "/", nil)
+	require.Equal(t, 401, a.authorize(req))
+	require.Equal(t, 401, a.authorize(bearerRequest("not-a-token")))
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	require.Equal(t, 401, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodRS256, "rsa", other, valid))))
+	require.Equal(t, 401, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodRS256, "unknown", rsaKey, valid))))
+	// an HMAC token signed with the public key must not be accepted
+	require.Equal(t, 401, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), valid))))
+
+	expired := testClaims(valid, "exp", time.Now().Add(-time.Hour).Unix())
+	require.Equal(t, 401, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, expired))))
+	noExpiry := testClaims(valid, "exp", nil)
+	require.Equal(t, 401, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, noExpiry))))
+	wrongIssuer := testClaims(valid, "iss", "https://evil.example.com")
+	require.Equal(t, 401, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, wrongIssuer))))
+
+	// valid tokens without permission
+	wrongAudience := testClaims(valid, "aud", []string{"api"})
+	require.Equal(t, 403, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, wrongAudience))))
+	wrongGroup := testClaims(valid, "groups", []string{"dev"})
+	require.Equal(t, 403, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, wrongGroup))))
+	noGroup := testClaims(valid, "groups", nil)
+	require.Equal(t, 403, a.authorize(bearerRequest(testToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, noGroup))))
+
+	// the JWKS file is never served
+	_, _, ok := resolveFile(dir, "/auth/jwks.json")
+	require.False(t, ok)
+}
+
+func TestJWTAuthWithSecretAndCookie(t *testing.T) {
+	a, err := parseJWTAuth("secret=s3cret cookie=token claim=admin=true", "")
+	require.NoError(t, err)
+
+	claims := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "admin": true}
+	token := testToken(t, jwt.SigningMethodHS256, "", []byte("s3cret"), claims)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	require.Equal(t, 200, a.authorize(req))
+	require.Equal(t, 200, a.authorize(bearerRequest(token)))
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "other", Value: token})
+	require.Equal(t, 401, a.authorize(req))
+
+	token = testToken(t, jwt.SigningMethodHS256, "", []byte("wrong"), claims)
+	require.Equal(t, 401, a.authorize(bearerRequest(token)))
+
+	token = testToken(t, jwt.SigningMethodHS256, "", []byte("s3cret"), testClaims(claims, "admin", false))
+	require.Equal(t, 403, a.authorize(bearerRequest(token)))
+}
+
+func TestParseJWTAuthErrors(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"invalid.json": "{",
+		"empty.json":   `{"keys": []}`,
+	})
+	for _, invalid := range []string{
+		"aud=docs",
+		"secret=",
+		"secret=s3cret unknown=1",
+		"secret=s3cret claim=role",
+		"jwks=missing.json",
+		"jwks=invalid.json",
+		"jwks=empty.json",
+	} {
+		_, err := parseJWTAuth(invalid, dir)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestPathJWTAuth(t *testing.T) {
+	headers, err := NewHeaders([]byte("/docs/*\n  JWT-Auth: secret=s3cret aud=docs\n  X-Docs: yes"))
+	require.NoError(t, err)
+	claims := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "aud": "docs"}
+
+	req, _ := http.NewRequest("GET", "/docs/", nil)
+	res := testHeader(headers[0], req)
+	require.Equal(t, 401, res.Code)
+	require.Equal(t, "Bearer", res.Header().Get("WWW-Authenticate"))
+
+	res = testHeader(headers[0], bearerRequest(testToken(t, jwt.SigningMethodHS256, "", []byte("s3cret"), testClaims(claims, "aud", "api"))))
+	require.Equal(t, 403, res.Code)
+
+	res = testHeader(headers[0], bearerRequest(testToken(t, jwt.SigningMethodHS256, "", []byte("s3cret"), claims)))
+	require.Equal(t, 200, res.Code)
+	require.Equal(t, "yes", res.Header().Get("X-Docs"))
+
+	_, err = NewHeaders([]byte("/*\n  JWT-Auth: secret=a\n  Basic-Auth: user:pass"))
+	require.Error(t, err)
+	_, err = NewHeaders([]byte("/*\n  JWT-Auth: secret=a\n  JWT-Auth: secret=b"))
+	require.Error(t, err)
+}
+
+func bearerRequest(token string) *http.Request {
+	req, _ := http.NewRequest("GET", "/docs/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func testToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+// testClaims returns a copy of claims with the claim replaced, or removed if value is nil
+func testClaims(claims jwt.MapClaims, name string, value interface{}) jwt.MapClaims {
+	result := jwt.MapClaims{}
+	for k, v := range claims {
+		result[k] = v
+	}
+	if value == nil {
+		delete(result, name)
+	} else {
+		result[name] = value
+	}
+	return result
+}
+
+func testJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	set := map[string]interface{}{"keys": []map[string]string{
+		{"kid": "rsa", "kty": "RSA", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kid": "ec", "kty": "EC", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes())},
+		{"kid": "enc", "kty": "RSA", "use": "enc", "n": encode(rsaKey.N.Bytes()), "e": "AQAB"},
+	}}
+	data, err := json.Marshal(set)
+	require.NoError(t, err)
+	return string(data)
+}
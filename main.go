@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 )
 
 func main() {
@@ -16,9 +17,49 @@ func main() {
 
 	dir := flag.String("dir", wd, "directory path")
 	port := flag.Int("port", 8080, "port to use")
+	trailingSlash := flag.String("trailing-slash", "as-is", "trailing slash policy: as-is, add or strip")
+	caseSensitive := flag.Bool("case-sensitive", false, "match redirect and header rules case-sensitively")
+	spa := flag.Bool("spa", false, "serve index.html for unmatched routes of a single-page application")
+	compress := flag.Bool("compress", false, "compress text-like responses with gzip or Brotli on the fly")
+	cacheControl := flag.String("cache-control", DefaultCachePolicy.Default, "default Cache-Control of files, empty to disable")
+	immutableCacheControl := flag.String("immutable-cache-control", DefaultCachePolicy.Immutable, "default Cache-Control of fingerprinted files, empty to disable")
+	headerMatch := flag.String("header-match", "both", "which path of a rewrite gets _headers: both, original or rewritten")
+	skipRedirectHeaders := flag.Bool("skip-redirect-headers", false, "don't add _headers to 3xx responses")
+	skipProxyHeaders := flag.Bool("skip-proxy-headers", false, "don't add _headers to proxied responses")
+	password := flag.String("password", os.Getenv("SITEX_PASSWORD"), "protect the whole site with a login form, defaults to $SITEX_PASSWORD")
+	passwordExempt := flag.String("password-exempt", "/robots.txt,/favicon.ico,/.well-known/*", "comma-separated paths accessible without the site password")
+	sessionSecret := flag.String("session-secret", os.Getenv("SITEX_SESSION_SECRET"), "secret to sign login sessions, defaults to $SITEX_SESSION_SECRET or a random one")
+	sessionMaxAge := flag.Duration("session-max-age", DefaultSessionMaxAge, "how long a login lasts")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated CIDRs of reverse proxies whose X-Forwarded-For is trusted")
 	flag.Parse()
 
-	server, err := NewServer(*dir)
+	config := Config{
+		CaseSensitive: *caseSensitive,
+		SPA:           *spa,
+		Compress:      *compress,
+		CachePolicy:   &CachePolicy{Default: *cacheControl, Immutable: *immutableCacheControl},
+	}
+	config.TrailingSlash, err = ParseTrailingSlash(*trailingSlash)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.HeaderPolicy.Match, err = ParseHeaderMatch(*headerMatch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.HeaderPolicy.SkipRedirects = *skipRedirectHeaders
+	config.HeaderPolicy.SkipProxy = *skipProxyHeaders
+	config.Password = *password
+	config.SessionSecret = *sessionSecret
+	config.SessionMaxAge = *sessionMaxAge
+	if *trustedProxies != "" {
+		config.TrustedProxies = strings.Split(*trustedProxies, ",")
+	}
+	if *passwordExempt != "" {
+		config.PasswordExempt = strings.Split(*passwordExempt, ",")
+	}
+
+	server, err := NewServer(*dir, config)
 	if err != nil {
 		log.Fatal(err)
 	}
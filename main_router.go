@@ -5,18 +5,53 @@ import (
 )
 
 type MainRouter struct {
+	// rateLimits reject clients sending too many requests before anything else runs
+	rateLimits []middleware
+	// normalize redirects requests to canonical paths, such as the trailing slash policy
+	normalize []middleware
+	// guards protect the whole site before any rule runs, such as the site-wide password
+	guards                []middleware
 	headers               []middleware
 	shadowingRedirects    []middleware
 	nonShadowingRedirects []middleware
 	fileServer            middleware
+	// fallbacks handle requests which don't match anything else, such as the SPA fallback
+	fallbacks []middleware
+	// compress enables on-the-fly compression of text-like responses
+	compress bool
 }
 
 func (main MainRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// rules match the request path, so it must be the path of the served file.
+	// Otherwise `/x/../admin/` would skip rules of `/admin/*`.
+	if containsDotDot(r.URL.Path) {
+		http.Error(w, "invalid URL path", 400)
+		return
+	}
+	if clean := cleanPath(r.URL.Path); clean != r.URL.Path {
+		u := *r.URL
+		u.Path = clean
+		u.RawPath = ""
+		r = r.WithContext(r.Context())
+		r.URL = &u
+	}
+
+	if main.compress {
+		cw := newCompressWriter(w, r)
+		defer cw.Close()
+		w = cw
+	}
+	w = &hookWriter{ResponseWriter: w}
+
 	run([][]middleware{
+		main.rateLimits,
+		main.normalize,
+		main.guards,
 		main.headers,
 		main.shadowingRedirects,
 		{main.fileServer},
 		main.nonShadowingRedirects,
+		main.fallbacks,
 	}, w, r)
 }
 
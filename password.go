@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cryptAlphabet is the base64 alphabet used by crypt(3)
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	// maxSHA256CryptRounds limits the work of checking a SHA-256 crypt password, it runs on every request
+	maxSHA256CryptRounds = 50000
+	// maxBcryptCost limits the work of checking a wrong bcrypt password, it runs on every request
+	maxBcryptCost = 10
+)
+
+// verifiedPasswords are successful checks of hashed passwords by a SHA-256 of the stored password and the password.
+// Browsers send Basic-Auth with every request, so a user only pays for a slow hash once.
+// Only correct passwords are kept, so it can't grow larger than the number of users.
+var verifiedPasswords = struct {
+	sync.RWMutex
+	checks map[[sha256.Size]byte]bool
+}{checks: make(map[[sha256.Size]byte]bool)}
+
+var (
+	sha256CryptHash = regexp.MustCompile(`^\$5\$(?:rounds=([0-9]+)\$)?[^$:]*\$[./0-9A-Za-z]{43}$`)
+	apr1Hash        = regexp.MustCompile(`^\$apr1\$[^$:]{0,8}\$[./0-9A-Za-z]{22}$`)
+)
+
+// validatePassword returns an error if the stored password looks like a hash but is malformed,
+// or if checking it would take too much work. Passwords are validated when rules are loaded,
+// so a broken hash fails at startup instead of at the first login.
+func validatePassword(stored string) error {
+	switch {
+	case stored == "":
+		return fmt.Errorf("Empty password")
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		cost, err := bcrypt.Cost([]byte(stored))
+		if err != nil {
+			return fmt.Errorf("Invalid bcrypt hash: %v", err)
+		}
+		if cost > maxBcryptCost {
+			return fmt.Errorf("bcrypt cost %d is more than %d", cost, maxBcryptCost)
+		}
+	case strings.HasPrefix(stored, "$5$"):
+		m := sha256CryptHash.FindStringSubmatch(stored)
+		if m == nil {
+			return fmt.Errorf("Invalid SHA-256 crypt hash")
+		}
+		if m[1] != "" {
+			rounds, err := strconv.Atoi(m[1])
+			if err != nil || rounds > maxSHA256CryptRounds {
+				return fmt.Errorf("SHA-256 crypt rounds must be at most %d", maxSHA256CryptRounds)
+			}
+		}
+	case strings.HasPrefix(stored, "$apr1$"):
+		if !apr1Hash.MatchString(stored) {
+			return fmt.Errorf("Invalid APR1 hash")
+		}
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum, err := base64.StdEncoding.DecodeString(stored[len("{SHA}"):])
+		if err != nil || len(sum) != sha1.Size {
+			return fmt.Errorf("Invalid SHA-1 hash")
+		}
+	}
+	return nil
+}
+
+// checkPassword returns true if the password matches the stored password.
+// The stored password can be plaintext, or a hash used by Apache htpasswd:
+// bcrypt (`$2y$`), SHA-256 crypt (`$5$`), APR1 (`$apr1$`) or SHA-1 (`{SHA}`).
+func checkPassword(stored string, password string) bool {
+	var hashed string
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return checkSlowHash(stored, password, func() bool {
+			return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+		})
+	case strings.HasPrefix(stored, "$5$"):
+		return checkSlowHash(stored, password, func() bool {
+			return subtle.ConstantTimeCompare([]byte(stored), []byte(sha256Crypt(password, stored))) == 1
+		})
+	case strings.HasPrefix(stored, "$apr1$"):
+		hashed = apr1Crypt(password, stored)
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		hashed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		hashed = password
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1
+}
+
+// checkSlowHash runs check unless the password is already verified, see verifiedPasswords
+func checkSlowHash(stored string, password string, check func() bool) bool {
+	key := sha256.Sum256([]byte(stored + "\x00" + password))
+	verifiedPasswords.RLock()
+	ok := verifiedPasswords.checks[key]
+	verifiedPasswords.RUnlock()
+	if ok {
+		return true
+	}
+	if !check() {
+		return false
+	}
+	verifiedPasswords.Lock()
+	verifiedPasswords.checks[key] = true
+	verifiedPasswords.Unlock()
+	return true
+}
+
+// loadHtpasswd returns users defined in an Apache-style htpasswd file
+func loadHtpasswd(file string) ([]auth, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	auths := make([]auth, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) < 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("Invalid htpasswd line in %s: %s", file, line)
+		}
+		if err := validatePassword(pair[1]); err != nil {
+			return nil, fmt.Errorf("%v in %s for user %s", err, file, pair[0])
+		}
+		auths = append(auths, auth{pair[0], pair[1]})
+	}
+	return auths, scanner.Err()
+}
+
+// sha256Crypt hashes the password with the salt and rounds of the stored SHA-256 crypt hash,
+// see https://www.akkadia.org/drepper/SHA-crypt.txt
+func sha256Crypt(password string, stored string) string {
+	fields := strings.Split(strings.TrimPrefix(stored, "$5$"), "$")
+	rounds := 5000
+	customRounds := false
+	if strings.HasPrefix(fields[0], "rounds=") {
+		if n, err := strconv.Atoi(strings.TrimPrefix(fields[0], "rounds=")); err == nil {
+			rounds = n
+			customRounds = true
+		}
+		fields = fields[1:]
+	}
+	if rounds < 1000 {
+		rounds = 1000
+	}
+	if rounds > maxSHA256CryptRounds {
+		rounds = maxSHA256CryptRounds
+	}
+	// a malformed hash never matches
+	if len(fields) < 2 {
+		return ""
+	}
+	salt := fields[0]
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p := []byte(password)
+	s := []byte(salt)
+
+	b := sha256.New()
+	b.Write(p)
+	b.Write(s)
+	b.Write(p)
+	sumB := b.Sum(nil)
+
+	a := sha256.New()
+	a.Write(p)
+	a.Write(s)
+	a.Write(repeat(sumB, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(p)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha256.New()
+	for i := 0; i < len(p); i++ {
+		dp.Write(p)
+	}
+	pBytes := repeat(dp.Sum(nil), len(p))
+
+	ds := sha256.New()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(s)
+	}
+	sBytes := repeat(ds.Sum(nil), len(s))
+
+	c := sumA
+	for i := 0; i < rounds; i++ {
+		h := sha256.New()
+		if i&1 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(pBytes)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pBytes)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$5$")
+	if customRounds {
+		out.WriteString(fmt.Sprintf("rounds=%d$", rounds))
+	}
+	out.WriteString(salt)
+	out.WriteString("$")
+	for _, g := range [][3]int{{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14}, {15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29}} {
+		out.WriteString(crypt64(uint(c[g[0]])<<16|uint(c[g[1]])<<8|uint(c[g[2]]), 4))
+	}
+	out.WriteString(crypt64(uint(c[31])<<8|uint(c[30]), 3))
+	return out.String()
+}
+
+// apr1Crypt hashes the password with the salt of the stored APR1 hash, the MD5 variant used by Apache
+func apr1Crypt(password string, stored string) string {
+	const magic = "$apr1$"
+	salt := strings.SplitN(strings.TrimPrefix(stored, magic), "$", 2)[0]
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	p := []byte(password)
+	s := []byte(salt)
+
+	alt := md5.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	sumAlt := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(p)
+	ctx.Write([]byte(magic))
+	ctx.Write(s)
+	ctx.Write(repeat(sumAlt, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(p[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(p)
+		}
+		final = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic)
+	out.WriteString(salt)
+	out.WriteString("$")
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		out.WriteString(crypt64(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4))
+	}
+	out.WriteString(crypt64(uint(final[11]), 2))
+	return out.String()
+}
+
+// repeat returns the data repeated until it's n bytes long
+func repeat(data []byte, n int) []byte {
+	result := make([]byte, 0, n)
+	for len(result) < n {
+		result = append(result, data...)
+	}
+	return result[:n]
+}
+
+// crypt64 encodes the lowest n*6 bits of v with the crypt(3) base64 alphabet
+func crypt64(v uint, n int) string {
+	result := make([]byte, n)
+	for i := 0; i < n; i++ {
+		result[i] = cryptAlphabet[v&0x3f]
+		v >>= 6
+	}
+	return string(result)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPlaintextPassword(t *testing.T) {
+	require.True(t, checkPassword("pass", "pass"))
+	require.False(t, checkPassword("pass", "pas"))
+	require.False(t, checkPassword("pass", ""))
+}
+
+func TestCheckBcryptPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("myPassword"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	require.True(t, checkPassword(string(hash), "myPassword"))
+	require.False(t, checkPassword(string(hash), "wrong"))
+
+	// htpasswd -B uses the $2y$ prefix
+	apache := "$2y$" + string(hash)[4:]
+	require.True(t, checkPassword(apache, "myPassword"))
+}
+
+func TestCheckPasswordCachesVerifiedHashes(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("cached"), bcrypt.MinCost)
+	require.NoError(t, err)
+	key := sha256.Sum256([]byte(string(hash) + "\x00" + "cached"))
+
+	require.False(t, checkPassword(string(hash), "wrong"))
+	require.False(t, verifiedPasswords.checks[sha256.Sum256([]byte(string(hash)+"\x00"+"wrong"))])
+
+	require.True(t, checkPassword(string(hash), "cached"))
+	require.True(t, verifiedPasswords.checks[key])
+	require.True(t, checkPassword(string(hash), "cached"))
+	require.False(t, checkPassword(string(hash), "wrong"))
+
+	// a higher cost than maxBcryptCost is refused when rules are loaded
+	hash, err = bcrypt.GenerateFromPassword([]byte("slow"), maxBcryptCost+1)
+	require.NoError(t, err)
+	require.Error(t, validatePassword(string(hash)))
+}
+
+func TestCheckSHA256CryptPassword(t *testing.T) {
+	// openssl passwd -5 -salt saltstring "Hello world!"
+	require.True(t, checkPassword("$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"))
+	require.True(t, checkPassword("$5$saltstringsaltst$a5C8Ofk71MUIoKve2QuP9FMl.dwNgseF5tR1LGAL7iB", "Hello world!"))
+	// from the SHA-crypt specification
+	require.True(t, checkPassword("$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"))
+	require.False(t, checkPassword("$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world"))
+}
+
+func TestCheckAPR1Password(t *testing.T) {
+	// openssl passwd -apr1 -salt qHDFfhPC myPassword
+	require.True(t, checkPassword("$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0", "myPassword"))
+	require.False(t, checkPassword("$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0", "myPasswort"))
+}
+
+func TestCheckSHA1Password(t *testing.T) {
+	// htpasswd -nbs myName myPassword
+	require.True(t, checkPassword("{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=", "myPassword"))
+	require.False(t, checkPassword("{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=", "password"))
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"users.htpasswd": "# users\nalice:$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0\n\nbob:plain:text\n",
+		"invalid":        "alice\n",
+	})
+
+	auths, err := loadHtpasswd(filepath.Join(dir, "users.htpasswd"))
+	require.NoError(t, err)
+	require.Equal(t, []auth{{"alice", "$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0"}, {"bob", "plain:text"}}, auths)
+
+	_, err = loadHtpasswd(filepath.Join(dir, "invalid"))
+	require.Error(t, err)
+
+	_, err = loadHtpasswd(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestValidatePassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("myPassword"), bcrypt.MinCost)
+	require.NoError(t, err)
+	require.NoError(t, validatePassword(string(hash)))
+	require.NoError(t, validatePassword("$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"))
+	require.NoError(t, validatePassword("$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"))
+	require.NoError(t, validatePassword("$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0"))
+	require.NoError(t, validatePassword("{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE="))
+	require.NoError(t, validatePassword("plain:text"))
+
+	require.Error(t, validatePassword(""))
+	require.Error(t, validatePassword("$2y$10$short"))
+	require.Error(t, validatePassword("$2a$31$"+string(hash)[7:]))
+	require.Error(t, validatePassword("$5$rounds=5000"))
+	require.Error(t, validatePassword("$5$saltstring"))
+	require.Error(t, validatePassword("$5$rounds=999999999$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"))
+	require.Error(t, validatePassword("$apr1$qHDFfhPC"))
+	require.Error(t, validatePassword("{SHA}short"))
+
+	// a malformed hash never matches instead of panicking
+	require.False(t, checkPassword("$5$rounds=5000", ""))
+}
+
+func TestLoadHtpasswdInvalidHash(t *testing.T) {
+	dir := testDir(t, map[string]string{"users.htpasswd": "alice:$5$rounds=5000\n"})
+
+	_, err := loadHtpasswd(filepath.Join(dir, "users.htpasswd"))
+	require.Error(t, err)
+}
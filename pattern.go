@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// placeholderName matches a placeholder such as `:year` in a path pattern or a redirect destination
+var placeholderName = regexp.MustCompile(`:([A-Za-z_][A-Za-z0-9_]*)`)
+
+// pattern is a compiled Netlify-style path pattern, such as `/:lang/blog/*`.
+//
+// A placeholder (`:name`) matches a non-empty part of a single path segment,
+// it can appear anywhere in the path and can be surrounded by literals (e.g. `/news/year-:year`).
+// A splat (`*`) matches any sequence of characters, including slashes, and is captured as `splat`.
+type pattern struct {
+	names []string
+	re    *regexp.Regexp
+	// fold is the case-insensitive version of re
+	fold *regexp.Regexp
+}
+
+// newPattern compiles the given path pattern.
+// It returns an error instead of panicking if the pattern is malformed.
+func newPattern(raw string) (*pattern, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return nil, fmt.Errorf("Path must start with /: %s", raw)
+	}
+
+	p := &pattern{}
+	seen := make(map[string]bool)
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	rest := trimTrailingSlash(raw)
+	for len(rest) > 0 {
+		switch rest[0] {
+		case ':':
+			loc := placeholderName.FindStringSubmatchIndex(rest)
+			if loc == nil || loc[0] != 0 {
+				return nil, fmt.Errorf("Invalid placeholder in path: %s", raw)
+			}
+			name := rest[loc[2]:loc[3]]
+			if seen[name] {
+				return nil, fmt.Errorf("Duplicated placeholder :%s in path: %s", name, raw)
+			}
+			seen[name] = true
+			p.names = append(p.names, name)
+			expr.WriteString("([^/]+?)")
+			rest = rest[loc[1]:]
+		case '*':
+			if seen["splat"] {
+				return nil, fmt.Errorf("Duplicated splat in path: %s", raw)
+			}
+			seen["splat"] = true
+			p.names = append(p.names, "splat")
+			expr.WriteString("(.*)")
+			rest = strings.TrimPrefix(rest[1:], "splat")
+		default:
+			next := strings.IndexAny(rest, ":*")
+			if next < 0 {
+				next = len(rest)
+			}
+			expr.WriteString(regexp.QuoteMeta(rest[:next]))
+			rest = rest[next:]
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("Invalid path %s: %v", raw, err)
+	}
+	p.re = re
+	p.fold = regexp.MustCompile("(?i)" + expr.String())
+	return p, nil
+}
+
+// match returns captured placeholders and splat if the given path matches the pattern.
+// Like Netlify, `/about` and `/about/` are equivalent when matching.
+// Captured values keep their original case even if the match is case-insensitive.
+func (p *pattern) match(path string, caseSensitive bool) (map[string]string, bool) {
+	re := p.fold
+	if caseSensitive {
+		re = p.re
+	}
+	path = trimTrailingSlash(path)
+	m := re.FindStringSubmatch(path)
+	if m == nil {
+		// `/news` should match `/news/*` as well
+		m = re.FindStringSubmatch(path + "/")
+	}
+	if m == nil {
+		return nil, false
+	}
+	params := make(map[string]string, len(p.names))
+	for i, name := range p.names {
+		params[name] = m[i+1]
+	}
+	return params, true
+}
+
+// trimTrailingSlash removes the trailing slash of a path, except for the root path
+func trimTrailingSlash(path string) string {
+	if len(path) > 1 && strings.HasSuffix(path, "/") {
+		return path[:len(path)-1]
+	}
+	return path
+}
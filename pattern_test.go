@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatternLiteral(t *testing.T) {
+	p, err := newPattern("/blog/new")
+	require.NoError(t, err)
+
+	params, ok := p.match("/blog/new", true)
+	require.True(t, ok)
+	require.Empty(t, params)
+
+	_, ok = p.match("/blog/news", true)
+	require.False(t, ok)
+	_, ok = p.match("/blog", true)
+	require.False(t, ok)
+}
+
+func TestPatternPlaceholderMidPath(t *testing.T) {
+	p, err := newPattern("/:lang/blog/:slug")
+	require.NoError(t, err)
+
+	params, ok := p.match("/en/blog/hello", true)
+	require.True(t, ok)
+	require.Equal(t, "en", params["lang"])
+	require.Equal(t, "hello", params["slug"])
+
+	_, ok = p.match("/en/blog/hello/world", true)
+	require.False(t, ok)
+	_, ok = p.match("//blog/hello", true)
+	require.False(t, ok)
+}
+
+func TestPatternPlaceholderWithLiteral(t *testing.T) {
+	p, err := newPattern("/news/:year-:month.html")
+	require.NoError(t, err)
+
+	params, ok := p.match("/news/2017-05.html", true)
+	require.True(t, ok)
+	require.Equal(t, "2017", params["year"])
+	require.Equal(t, "05", params["month"])
+}
+
+func TestPatternSplatAfterPlaceholder(t *testing.T) {
+	p, err := newPattern("/:lang/*")
+	require.NoError(t, err)
+
+	params, ok := p.match("/en/docs/intro.html", true)
+	require.True(t, ok)
+	require.Equal(t, "en", params["lang"])
+	require.Equal(t, "docs/intro.html", params["splat"])
+}
+
+func TestPatternSplatInTheMiddle(t *testing.T) {
+	p, err := newPattern("/assets/*/logo.png")
+	require.NoError(t, err)
+
+	params, ok := p.match("/assets/img/v2/logo.png", true)
+	require.True(t, ok)
+	require.Equal(t, "img/v2", params["splat"])
+}
+
+func TestPatternNamedSplat(t *testing.T) {
+	p, err := newPattern("/news/*splat")
+	require.NoError(t, err)
+
+	params, ok := p.match("/news/foo", true)
+	require.True(t, ok)
+	require.Equal(t, "foo", params["splat"])
+}
+
+func TestPatternEscapesRegexp(t *testing.T) {
+	p, err := newPattern("/a.b/(c)")
+	require.NoError(t, err)
+
+	_, ok := p.match("/a.b/(c)", true)
+	require.True(t, ok)
+	_, ok = p.match("/axb/(c)", true)
+	require.False(t, ok)
+}
+
+func TestPatternErrors(t *testing.T) {
+	for _, raw := range []string{
+		"blog/:slug",
+		"/blog/:",
+		"/blog/:1",
+		"/:slug/:slug",
+		"/*/foo/*",
+	} {
+		_, err := newPattern(raw)
+		require.Error(t, err, raw)
+	}
+}
+
+func TestPatternTrailingSlash(t *testing.T) {
+	p, err := newPattern("/about")
+	require.NoError(t, err)
+	_, ok := p.match("/about/", true)
+	require.True(t, ok)
+
+	p, err = newPattern("/about/")
+	require.NoError(t, err)
+	_, ok = p.match("/about", true)
+	require.True(t, ok)
+
+	p, err = newPattern("/news/*")
+	require.NoError(t, err)
+	params, ok := p.match("/news", true)
+	require.True(t, ok)
+	require.Equal(t, "", params["splat"])
+}
+
+func TestPatternCaseInsensitive(t *testing.T) {
+	p, err := newPattern("/About/:name")
+	require.NoError(t, err)
+
+	params, ok := p.match("/about/JohnDoe", false)
+	require.True(t, ok)
+	require.Equal(t, "JohnDoe", params["name"])
+
+	_, ok = p.match("/about/JohnDoe", true)
+	require.False(t, ok)
+	_, ok = p.match("/About/JohnDoe", true)
+	require.True(t, ok)
+}
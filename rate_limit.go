@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBuckets is the number of clients tracked by a rate limit, the least recently seen client is forgotten first
+const maxBuckets = 10000
+
+// RateLimit correspond to a line in the _ratelimits config, such as `/api/* 60/1m burst=10 key=ip`.
+// It's a token bucket per client: a client can send Burst requests at once,
+// then Limit requests per Window. Other requests get 429 with Retry-After.
+type RateLimit struct {
+	From   string
+	Limit  int
+	Window time.Duration
+	// Burst is the size of the bucket, it's Limit by default
+	Burst int
+	// Header identifies clients by a request header in addition to the client IP.
+	// Its value is chosen by the client, so a request also takes a token of its IP,
+	// and rotating values can't get more requests than the IP.
+	Header string
+	// CaseSensitive disables Netlify's case-insensitive path matching
+	CaseSensitive bool
+	// TrustedProxies are networks of reverse proxies whose X-Forwarded-For is trusted
+	TrustedProxies []*net.IPNet
+	pattern        *pattern
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// recent orders buckets from the most recently seen client
+	recent *list.List
+	now    func() time.Time
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// Match returns true if the request is limited by the rule
+func (rl *RateLimit) Match(r *http.Request) bool {
+	_, ok := rl.pattern.match(r.URL.Path, rl.CaseSensitive)
+	return ok
+}
+
+// Handle takes a token of the client, or replies with 429 if the client runs out of tokens
+func (rl *RateLimit) Handle(w http.ResponseWriter, r *http.Request) bool {
+	if !rl.Match(r) {
+		return true
+	}
+
+	retryAfter, ok := rl.take(rl.keys(r)...)
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(429)
+	w.Write([]byte("Too Many Requests.\n"))
+	return false
+}
+
+// keys returns the identities of the client, the request is limited by each of them
+func (rl *RateLimit) keys(r *http.Request) []string {
+	keys := []string{"ip:" + clientIP(r, rl.TrustedProxies).String()}
+	if rl.Header != "" {
+		if value := r.Header.Get(rl.Header); value != "" {
+			keys = append(keys, "header:"+value)
+		}
+	}
+	return keys
+}
+
+// rate returns tokens added to a bucket per second
+func (rl *RateLimit) rate() float64 {
+	return float64(rl.Limit) / rl.Window.Seconds()
+}
+
+// take takes a token from the bucket of each key, only if all of them have a token left.
+// It returns how long the client should wait if there's no token left.
+func (rl *RateLimit) take(keys ...string) (time.Duration, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	buckets := make([]*bucket, 0, len(keys))
+	var wait time.Duration
+	for _, key := range keys {
+		b := rl.bucket(key, now)
+		b.tokens = math.Min(float64(rl.Burst), b.tokens+now.Sub(b.last).Seconds()*rl.rate())
+		b.last = now
+		if b.tokens < 1 {
+			if d := time.Duration((1 - b.tokens) / rl.rate() * float64(time.Second)); d > wait {
+				wait = d
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, true
+}
+
+// bucket returns the bucket of the key, a new client gets a full bucket
+func (rl *RateLimit) bucket(key string, now time.Time) *bucket {
+	if e, ok := rl.buckets[key]; ok {
+		rl.recent.MoveToFront(e)
+		return e.Value.(*bucket)
+	}
+	// forgetting the least recently seen client is O(1), even if clients keep changing their key
+	if rl.recent.Len() >= maxBuckets {
+		oldest := rl.recent.Back()
+		rl.recent.Remove(oldest)
+		delete(rl.buckets, oldest.Value.(*bucket).key)
+	}
+	b := &bucket{key: key, tokens: float64(rl.Burst), last: now}
+	rl.buckets[key] = rl.recent.PushFront(b)
+	return b
+}
+
+// NewRateLimit returns a rate limit based on given rule
+func NewRateLimit(line []byte) (*RateLimit, error) {
+	rule := comment.ReplaceAll(line, []byte(""))
+	rule = bytes.Trim(rule, " \t")
+
+	// skip empty line or comment line
+	if len(rule) == 0 {
+		return nil, nil
+	}
+
+	fields := strings.Fields(string(rule))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("Invalid Rate Limit Rule: %s", line)
+	}
+
+	rl := &RateLimit{buckets: make(map[string]*list.Element), recent: list.New(), now: time.Now}
+
+	from := fields[0]
+	if strings.HasSuffix(from, "*") {
+		from = from + "splat"
+	}
+	p, err := newPattern(from)
+	if err != nil {
+		return nil, err
+	}
+	rl.From = from
+	rl.pattern = p
+
+	// rate, such as `60/1m` or `10/s`
+	rate := strings.SplitN(fields[1], "/", 2)
+	if len(rate) < 2 {
+		return nil, fmt.Errorf("Invalid rate, expect requests/window: %s", line)
+	}
+	rl.Limit, err = strconv.Atoi(rate[0])
+	if err != nil || rl.Limit <= 0 {
+		return nil, fmt.Errorf("Invalid rate, expect requests/window: %s", line)
+	}
+	window := rate[1]
+	if window != "" && (window[0] < '0' || window[0] > '9') {
+		window = "1" + window
+	}
+	rl.Window, err = time.ParseDuration(window)
+	if err != nil || rl.Window <= 0 {
+		return nil, fmt.Errorf("Invalid rate window: %s", line)
+	}
+	rl.Burst = rl.Limit
+
+	for _, option := range fields[2:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) < 2 {
+			return nil, fmt.Errorf("Invalid option %s: %s", option, line)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "burst":
+			rl.Burst, err = strconv.Atoi(kv[1])
+			if err != nil || rl.Burst <= 0 {
+				return nil, fmt.Errorf("Invalid burst: %s", line)
+			}
+		case "key":
+			switch {
+			case kv[1] == "ip":
+				rl.Header = ""
+			case strings.HasPrefix(kv[1], "header:") && len(kv[1]) > len("header:"):
+				rl.Header = http.CanonicalHeaderKey(kv[1][len("header:"):])
+			default:
+				return nil, fmt.Errorf("Invalid key, expect ip or header:Name: %s", line)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid option %s: %s", option, line)
+		}
+	}
+
+	return rl, nil
+}
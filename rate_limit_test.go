@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRateLimit(t *testing.T) {
+	rl, err := NewRateLimit([]byte("/api/* 60/1m burst=10 key=header:x-api-key # staging api"))
+	require.NoError(t, err)
+	require.Equal(t, "/api/*splat", rl.From)
+	require.Equal(t, 60, rl.Limit)
+	require.Equal(t, time.Minute, rl.Window)
+	require.Equal(t, 10, rl.Burst)
+	require.Equal(t, "X-Api-Key", rl.Header)
+
+	rl, err = NewRateLimit([]byte("/search 5/s"))
+	require.NoError(t, err)
+	require.Equal(t, time.Second, rl.Window)
+	require.Equal(t, 5, rl.Burst)
+	require.Equal(t, "", rl.Header)
+
+	rl, err = NewRateLimit([]byte("  # comment"))
+	require.NoError(t, err)
+	require.Nil(t, rl)
+
+	for _, invalid := range []string{
+		"/api/*",
+		"/api/* 60",
+		"/api/* 0/1m",
+		"/api/* 60/forever",
+		"/api/* 60/1m burst=0",
+		"/api/* 60/1m key=cookie",
+		"/api/* 60/1m key=header:",
+		"/api/* 60/1m limit",
+		"api 60/1m",
+	} {
+		_, err = NewRateLimit([]byte(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rl, err := NewRateLimit([]byte("/api/* 60/1m burst=2"))
+	require.NoError(t, err)
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+
+	send := func(remote string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/users", nil)
+		req.RemoteAddr = remote
+		if rl.Handle(rec, req) {
+			rec.WriteHeader(200)
+		}
+		return rec
+	}
+
+	require.Equal(t, 200, send("203.0.113.7:1000").Code)
+	require.Equal(t, 200, send("203.0.113.7:1001").Code)
+	rec := send("203.0.113.7:1002")
+	require.Equal(t, 429, rec.Code)
+	require.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	// other clients have their own bucket
+	require.Equal(t, 200, send("203.0.113.8:1000").Code)
+
+	// a token is added every second
+	now = now.Add(time.Second)
+	require.Equal(t, 200, send("203.0.113.7:1000").Code)
+	require.Equal(t, 429, send("203.0.113.7:1000").Code)
+
+	// the bucket never exceeds the burst
+	now = now.Add(time.Hour)
+	require.Equal(t, 200, send("203.0.113.7:1000").Code)
+	require.Equal(t, 200, send("203.0.113.7:1000").Code)
+	require.Equal(t, 429, send("203.0.113.7:1000").Code)
+
+	// other paths are not limited
+	req, _ := http.NewRequest("GET", "/about", nil)
+	req.RemoteAddr = "203.0.113.7:1000"
+	require.True(t, rl.Handle(httptest.NewRecorder(), req))
+}
+
+func TestRateLimitByHeader(t *testing.T) {
+	rl, err := NewRateLimit([]byte("/api/* 1/1m key=header:X-Api-Key"))
+	require.NoError(t, err)
+
+	send := func(ip string, apiKey string) bool {
+		req, _ := http.NewRequest("GET", "/api/users", nil)
+		req.RemoteAddr = ip + ":1000"
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		return rl.Handle(httptest.NewRecorder(), req)
+	}
+
+	require.True(t, send("203.0.113.7", "a"))
+	require.False(t, send("203.0.113.8", "a"))
+	// the header is chosen by the client, so rotating it doesn't escape the limit of the IP
+	require.False(t, send("203.0.113.7", "b"))
+	require.False(t, send("203.0.113.7", ""))
+	// a refused request doesn't take the token of the other key
+	require.True(t, send("203.0.113.8", "c"))
+	require.True(t, send("203.0.113.10", ""))
+	require.False(t, send("203.0.113.10", ""))
+}
+
+func TestRateLimitForgetsLeastRecentClients(t *testing.T) {
+	rl, err := NewRateLimit([]byte("/* 1/1h"))
+	require.NoError(t, err)
+
+	_, ok := rl.take("first")
+	require.True(t, ok)
+	_, ok = rl.take("second")
+	require.True(t, ok)
+	for i := 0; i < maxBuckets-2; i++ {
+		rl.take(strconv.Itoa(i))
+	}
+	// first is seen again, so second is the least recent client
+	_, ok = rl.take("first")
+	require.False(t, ok)
+
+	// clients rotating keys never grow the map
+	for i := 0; i < 5*maxBuckets; i++ {
+		rl.take("rotating" + strconv.Itoa(i))
+	}
+	require.Len(t, rl.buckets, maxBuckets)
+	require.Equal(t, maxBuckets, rl.recent.Len())
+
+	// forgotten clients start with a full bucket
+	_, ok = rl.take("second")
+	require.True(t, ok)
+	_, ok = rl.take("second")
+	require.False(t, ok)
+}
+
+func TestRateLimitMatchesCleanedPath(t *testing.T) {
+	rl, err := NewRateLimit([]byte("/api/* 1/1h"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/api/a.txt", nil)
+	require.True(t, rl.Match(req))
+
+	server := testServer(t, Config{}, map[string]string{
+		"_ratelimits": "/api/* 1/1h",
+		"api/a.txt":   "a",
+	})
+	require.Equal(t, 200, serve(server, "GET", "/api/a.txt").Code)
+	// the router cleans the path before rate limits
+	for _, p := range []string{"/api/a.txt", "/./api/a.txt", "/.//api/a.txt"} {
+		require.Equal(t, 429, serve(server, "GET", p).Code, p)
+	}
+	// the router refuses `..` before any rule
+	for _, p := range []string{"/x/../api/a.txt", "/x/%2e%2e/api/a.txt"} {
+		require.Equal(t, 400, serve(server, "GET", p).Code, p)
+	}
+}
@@ -9,11 +9,7 @@ import (
 
 	"strings"
 
-	"path/filepath"
-
 	"io/ioutil"
-
-	"github.com/julienschmidt/httprouter"
 )
 
 // Redirect correspond to a line in the _redirect config
@@ -24,40 +20,52 @@ type Redirect struct {
 	To         string
 	wd         string
 	Shadowing  bool
-	router     *httprouter.Router
+	// CaseSensitive disables Netlify's case-insensitive path matching
+	CaseSensitive bool
+	// Methods are http methods the rule applies to
+	Methods []string
+	// CachePolicy is the default Cache-Control of rewritten files
+	CachePolicy *CachePolicy
+	// Headers are _headers rules which are matched with the rewrite destination
+	Headers []middleware
+	// HeaderMatch decides whether headers of the rewrite destination are added
+	HeaderMatch HeaderMatch
+	pattern     *pattern
 }
 
 func (redirect *Redirect) Match(r *http.Request) bool {
-	handle, _, _ := redirect.router.Lookup(r.Method, r.URL.Path)
-	if handle == nil {
-		return false
+	_, ok := redirect.lookup(r)
+	return ok
+}
+
+// lookup returns captured params if the request is a match to the rule
+func (redirect *Redirect) lookup(r *http.Request) (map[string]string, bool) {
+	if !hasMethod(redirect.Methods, r.Method) {
+		return nil, false
+	}
+
+	params, ok := redirect.pattern.match(r.URL.Path, redirect.CaseSensitive)
+	if !ok {
+		return nil, false
 	}
 
 	// check if query params matched the request
-	if len(redirect.Queries) > 0 {
-		queryMatched := true
-		for query := range redirect.Queries {
-			if r.URL.Query().Get(query) == "" {
-				queryMatched = false
-				break
-			}
-		}
-		if !queryMatched {
-			return false
+	for query := range redirect.Queries {
+		if r.URL.Query().Get(query) == "" {
+			return nil, false
 		}
 	}
 
-	return true
+	return params, true
 }
 
 // Handle handle the request and stop middleware chain if necessary
 func (redirect *Redirect) Handle(w http.ResponseWriter, r *http.Request) bool {
-	if !redirect.Match(r) {
+	params, ok := redirect.lookup(r)
+	if !ok {
 		return true
 	}
-	handle, params, _ := redirect.router.Lookup(r.Method, r.URL.Path)
-	handle(w, r, params)
-	return false
+	return redirect.handler(w, r, params)
 }
 
 // IsProxy returns true if the route is a proxy route.
@@ -69,74 +77,81 @@ func (redirect *Redirect) IsProxy() bool {
 
 // compileRedirectTo returns a string representing the destination of a request
 // based on matched route, placeholder, splat, and query params.
-func (redirect *Redirect) compileRedirectTo(r *http.Request, ps httprouter.Params) string {
-	var pattern = redirect.To
-	// is there any splat in the pattern?
-	if strings.HasSuffix(pattern, ":splat") {
-		splat := ps.ByName("splat")
-		splat = splat[1:] // remove "/" at the beginning
-		return strings.Replace(pattern, ":splat", splat, 1)
-	}
-
-	// does this require query param matching?
-	if len(redirect.Queries) > 0 {
-		result := pattern
-		for query, placeholder := range redirect.Queries {
-			result = strings.Replace(result, fmt.Sprintf(":%s", placeholder), r.URL.Query().Get(query), 1)
-		}
-		return result
+func (redirect *Redirect) compileRedirectTo(r *http.Request, params map[string]string) string {
+	values := make(map[string]string, len(params)+len(redirect.Queries))
+	for name, value := range params {
+		values[name] = value
 	}
-
-	// is there any placeholder in the pattern?
-	if strings.Contains(pattern, ":") {
-		varName := regexp.MustCompile(":[^/]+")
-		vars := varName.FindAllString(pattern, -1)
-		result := pattern
-		for _, v := range vars {
-			name := v[1:]
-			result = strings.Replace(result, v, ps.ByName(name), 1)
-		}
-		return result
+	for query, placeholder := range redirect.Queries {
+		values[placeholder] = r.URL.Query().Get(query)
 	}
 
-	// no replace needed
-	return pattern
+	// replace known placeholders only, so things like ports in a proxy URL are kept
+	return placeholderName.ReplaceAllStringFunc(redirect.To, func(v string) string {
+		if value, ok := values[v[1:]]; ok {
+			return value
+		}
+		return v
+	})
 }
 
-func (redirect *Redirect) handler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// handler sends the response of the rule, then returns whether the middleware chain should go on.
+// A rewrite falls through to the next rule if its destination doesn't exist.
+func (redirect *Redirect) handler(w http.ResponseWriter, r *http.Request, params map[string]string) bool {
 	if redirect.StatusCode >= 300 && redirect.StatusCode < 400 {
-		http.Redirect(w, r, redirect.compileRedirectTo(r, ps), redirect.StatusCode)
-		return
+		http.Redirect(w, r, redirect.compileRedirectTo(r, params), redirect.StatusCode)
+		return false
 	}
 
 	if redirect.IsProxy() {
-		req, err := http.NewRequest(r.Method, redirect.To, r.Body)
+		req, err := http.NewRequest(r.Method, redirect.compileRedirectTo(r, params), r.Body)
 		if err != nil {
 			w.WriteHeader(500)
-			return
+			return false
 		}
+		markProxied(w)
 		client := http.Client{}
 		resp, err := client.Do(req)
 		if err != nil {
 			w.WriteHeader(500)
-			return
+			return false
 		}
 		defer resp.Body.Close()
 
-		w.WriteHeader(resp.StatusCode)
-		for key, vals := range resp.Header {
-			w.Header().Set(key, vals[0])
-		}
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			w.WriteHeader(500)
-			return
+			return false
+		}
+		// headers must be set before writing the status code
+		for key, vals := range resp.Header {
+			w.Header()[key] = vals
 		}
+		w.WriteHeader(resp.StatusCode)
 		w.Write(body)
-		return
+		return false
 	}
 
-	http.ServeFile(w, r, filepath.Join(redirect.wd, redirect.compileRedirectTo(r, ps)))
+	// a rewrite, or a forced error such as 404 or 410 with the content of the destination
+	// the destination may contain a query string, such as `/a.html?v=1`
+	to := strings.SplitN(redirect.compileRedirectTo(r, params), "?", 2)[0]
+	file, _, ok := resolveFile(redirect.wd, to)
+	if !ok && redirect.StatusCode == 200 {
+		return true
+	}
+
+	markRewritten(w)
+	if redirect.HeaderMatch != HeaderMatchOriginal {
+		rewritten := rewrittenRequest(r, to)
+		for _, header := range redirect.Headers {
+			if !header.Handle(w, rewritten) {
+				return false
+			}
+		}
+	}
+	redirect.CachePolicy.apply(w.Header(), file)
+	serveFileWithStatus(w, r, file, redirect.StatusCode)
+	return false
 }
 
 // NewRedirect returns a route based on given redirect rule.
@@ -161,20 +176,29 @@ func NewRedirect(wd string, line []byte) (*Redirect, error) {
 		return nil, fmt.Errorf("Invalid Redirect Rule: %s", line)
 	}
 
-	redirect := Redirect{Queries: make(map[string]string), wd: wd, router: httprouter.New()}
+	redirect := Redirect{Queries: make(map[string]string), wd: wd}
 
 	// parse match
 	matcher, fields := takeField(fields)
-	// if it's a splat route, add a variable name for httprouter
+	// if it's a splat route, name the variable explicitly
 	if strings.HasSuffix(matcher, "*") {
 		matcher = matcher + "splat"
 	}
 	redirect.From = matcher
+	p, err := newPattern(matcher)
+	if err != nil {
+		return nil, err
+	}
+	redirect.pattern = p
 
 	// parse query params and to
 	// loop until we see and finished a redirect "to"
 	var f string
 	for {
+		// a line with only query params has no destination
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("Invalid Redirect Rule: %s", line)
+		}
 		f, fields = takeField(fields)
 		// if we got a query params
 		if t := strings.Split(f, "=:"); len(t) > 1 && !strings.Contains(f, "/") {
@@ -187,7 +211,7 @@ func NewRedirect(wd string, line []byte) (*Redirect, error) {
 
 	// if there's custom status code
 	var c string
-	if len(fields) > 0 {
+	if len(fields) > 0 && !bytes.Contains(fields[0], []byte("=")) {
 		c, fields = takeField(fields)
 		if strings.HasSuffix(c, "!") {
 			redirect.Shadowing = true
@@ -200,9 +224,25 @@ func NewRedirect(wd string, line []byte) (*Redirect, error) {
 		redirect.StatusCode = code
 	}
 
-	// must be error if there's still something left
-	if len(fields) > 0 {
-		return nil, fmt.Errorf("Invalid line: %s", line)
+	// conditions, such as `Method=POST,PUT`
+	for len(fields) > 0 {
+		c, fields = takeField(fields)
+		condition := strings.SplitN(c, "=", 2)
+		// must be error if there's still something left
+		if len(condition) < 2 {
+			return nil, fmt.Errorf("Invalid line: %s", line)
+		}
+		switch strings.ToLower(condition[0]) {
+		case "method":
+			for _, method := range strings.Split(strings.ToUpper(condition[1]), ",") {
+				if !hasMethod(METHODS, method) {
+					return nil, fmt.Errorf("Invalid Method %s: %s", method, line)
+				}
+				redirect.Methods = append(redirect.Methods, method)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid Condition %s: %s", condition[0], line)
+		}
 	}
 
 	// default status code
@@ -210,13 +250,17 @@ func NewRedirect(wd string, line []byte) (*Redirect, error) {
 		redirect.StatusCode = 301
 	}
 
-	if redirect.IsProxy() {
-		// hook to all methods if it's a proxy
-		for _, method := range METHODS {
-			redirect.router.Handle(method, redirect.From, redirect.handler)
+	if len(redirect.Methods) == 0 {
+		if redirect.IsProxy() {
+			// hook to all methods if it's a proxy
+			redirect.Methods = append([]string(nil), METHODS...)
+		} else {
+			redirect.Methods = []string{"GET"}
 		}
-	} else {
-		redirect.router.GET(redirect.From, redirect.handler)
+	}
+	// a HEAD request should behave like a GET request without body
+	if hasMethod(redirect.Methods, "GET") && !hasMethod(redirect.Methods, "HEAD") {
+		redirect.Methods = append(redirect.Methods, "HEAD")
 	}
 
 	return &redirect, nil
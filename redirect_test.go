@@ -86,11 +86,27 @@ func TestParseShadowingStatusCode(t *testing.T) {
 	require.Equal(t, "{\"foo\": \"bar\"}\n", resp.Body.String())
 }
 
+func TestParseQueryWithoutDestination(t *testing.T) {
+	_, err := NewRedirect(".", []byte("/bar id=:id"))
+	require.Error(t, err)
+	_, err = NewRedirect(".", []byte("/bar id=:id page=:page"))
+	require.Error(t, err)
+}
+
 func TestParseInvalidStatusCode(t *testing.T) {
 	_, err := NewRedirect(".", []byte("/ /foo bar"))
 	require.Error(t, err)
 }
 
+func TestParseProxyMethodsAreCopied(t *testing.T) {
+	redirect, err := NewRedirect(".", []byte("/api/* https://api.example.com/:splat 200"))
+	require.NoError(t, err)
+	require.Equal(t, METHODS, redirect.Methods)
+
+	redirect.Methods[0] = "CHANGED"
+	require.Equal(t, "GET", METHODS[0])
+}
+
 func TestParsePlaceholderRule(t *testing.T) {
 	route, err := NewRedirect(".", []byte("/news/:year /foo/:year"))
 	require.NoError(t, err)
@@ -220,3 +236,242 @@ func mockServer() *httptest.Server {
 	})
 	return httptest.NewServer(mux)
 }
+
+func TestParseOverlappingRules(t *testing.T) {
+	placeholder, err := NewRedirect(".", []byte("/blog/:slug /posts/:slug"))
+	require.NoError(t, err)
+	literal, err := NewRedirect(".", []byte("/blog/new /editor"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/blog/new", nil)
+	require.True(t, literal.Match(req))
+	require.True(t, placeholder.Match(req))
+
+	resp := testRequest(placeholder, req)
+	require.Equal(t, 301, resp.Code)
+	require.Equal(t, "/posts/new", resp.HeaderMap["Location"][0])
+}
+
+func TestParseSplatAfterPlaceholder(t *testing.T) {
+	route, err := NewRedirect(".", []byte("/:lang/docs/* /docs/:splat?lang=:lang"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/en/docs/intro/setup", nil)
+	require.True(t, route.Match(req))
+
+	resp := testRequest(route, req)
+	require.Equal(t, 301, resp.Code)
+	require.Equal(t, "/docs/intro/setup?lang=en", resp.HeaderMap["Location"][0])
+}
+
+func TestParseProxySplat(t *testing.T) {
+	ts := mockServer()
+	defer ts.Close()
+	route, err := NewRedirect(".", []byte(fmt.Sprintf("/api/* %s/:splat 200", ts.URL)))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/api/foo", nil)
+	require.True(t, route.Match(req))
+
+	resp := testRequest(route, req)
+	require.Equal(t, 200, resp.Code)
+	require.Equal(t, "METHOD: GET", resp.Body.String())
+}
+
+func TestParseInvalidPath(t *testing.T) {
+	_, err := NewRedirect(".", []byte("/:id/:id /foo"))
+	require.Error(t, err)
+
+	_, err = NewRedirect(".", []byte("/blog/: /foo"))
+	require.Error(t, err)
+}
+
+func TestParseTrailingSlashRule(t *testing.T) {
+	route, err := NewRedirect(".", []byte("/about /about-us"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/about/", nil)
+	require.True(t, route.Match(req))
+
+	resp := testRequest(route, req)
+	require.Equal(t, 301, resp.Code)
+	require.Equal(t, "/about-us", resp.HeaderMap["Location"][0])
+}
+
+func TestParseRewriteToDirectoryIndex(t *testing.T) {
+	route, err := NewRedirect("./example", []byte("/company /about/ 200"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/company", nil)
+	resp := testRequest(route, req)
+	require.Equal(t, 200, resp.Code)
+	require.Equal(t, "<h1>about</h1>\n", resp.Body.String())
+}
+
+func TestParseCaseInsensitiveRule(t *testing.T) {
+	route, err := NewRedirect(".", []byte("/About/:name /team/:name"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/about/JaneDoe", nil)
+	require.True(t, route.Match(req))
+
+	resp := testRequest(route, req)
+	require.Equal(t, 301, resp.Code)
+	require.Equal(t, "/team/JaneDoe", resp.HeaderMap["Location"][0])
+
+	route.CaseSensitive = true
+	require.False(t, route.Match(req))
+	req, _ = http.NewRequest("GET", "/About/JaneDoe", nil)
+	require.True(t, route.Match(req))
+}
+
+func TestParseHEADRequest(t *testing.T) {
+	route, err := NewRedirect(".", []byte("/ /foo"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"GET", "HEAD"}, route.Methods)
+
+	req, _ := http.NewRequest("HEAD", "/", nil)
+	require.True(t, route.Match(req))
+
+	resp := testRequest(route, req)
+	require.Equal(t, 301, resp.Code)
+	require.Equal(t, "/foo", resp.HeaderMap["Location"][0])
+
+	req, _ = http.NewRequest("POST", "/", nil)
+	require.False(t, route.Match(req))
+}
+
+func TestParseMethodCondition(t *testing.T) {
+	route, err := NewRedirect(".", []byte("/old-form /new-form 307 Method=POST,put"))
+	require.NoError(t, err)
+	require.Equal(t, 307, route.StatusCode)
+	require.Equal(t, []string{"POST", "PUT"}, route.Methods)
+
+	req, _ := http.NewRequest("POST", "/old-form", nil)
+	require.True(t, route.Match(req))
+
+	resp := testRequest(route, req)
+	require.Equal(t, 307, resp.Code)
+	require.Equal(t, "/new-form", resp.HeaderMap["Location"][0])
+
+	req, _ = http.NewRequest("GET", "/old-form", nil)
+	require.False(t, route.Match(req))
+}
+
+func TestParseMethodConditionWithoutStatusCode(t *testing.T) {
+	route, err := NewRedirect(".", []byte("/old-form /new-form Method=GET"))
+	require.NoError(t, err)
+	require.Equal(t, 301, route.StatusCode)
+	require.Equal(t, []string{"GET", "HEAD"}, route.Methods)
+}
+
+func TestParseInvalidCondition(t *testing.T) {
+	_, err := NewRedirect(".", []byte("/old-form /new-form 307 Method=FOO"))
+	require.Error(t, err)
+
+	_, err = NewRedirect(".", []byte("/old-form /new-form 307 Foo=bar"))
+	require.Error(t, err)
+}
+
+func TestParseProxyMethodCondition(t *testing.T) {
+	ts := mockServer()
+	defer ts.Close()
+	route, err := NewRedirect(".", []byte(fmt.Sprintf("/api %s 200 Method=POST", ts.URL)))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/api", nil)
+	require.False(t, route.Match(req))
+
+	req, _ = http.NewRequest("POST", "/api", nil)
+	resp := testRequest(route, req)
+	require.Equal(t, 200, resp.Code)
+	require.Equal(t, "METHOD: POST", resp.Body.String())
+}
+
+func TestParseForcedErrorRule(t *testing.T) {
+	route, err := NewRedirect("./example", []byte("/private/* /404.html 404"))
+	require.NoError(t, err)
+	require.Equal(t, 404, route.StatusCode)
+
+	req, _ := http.NewRequest("GET", "/private/foo", nil)
+	require.True(t, route.Match(req))
+
+	resp := testRequest(route, req)
+	require.Equal(t, 404, resp.Code)
+	require.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	require.Equal(t, "<h1>Not Found</h1>\n", resp.Body.String())
+
+	req, _ = http.NewRequest("HEAD", "/private/foo", nil)
+	resp = testRequest(route, req)
+	require.Equal(t, 404, resp.Code)
+	require.Equal(t, "", resp.Body.String())
+}
+
+func TestForcedErrorRuleHidesFiles(t *testing.T) {
+	// like other rules, an error rule without `!` doesn't shadow existing files
+	server := testServer(t, Config{}, map[string]string{
+		"_redirects":     "/private/* /404.html 404",
+		"404.html":       "gone",
+		"private/a.html": "secret",
+	})
+	rec := serve(server, "GET", "/private/a.html")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "secret", rec.Body.String())
+	require.Equal(t, 404, serve(server, "GET", "/private/b.html").Code)
+
+	server = testServer(t, Config{}, map[string]string{
+		"_redirects":     "/private/* /404.html 404!",
+		"404.html":       "gone",
+		"private/a.html": "secret",
+	})
+	rec = serve(server, "GET", "/private/a.html")
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "gone", rec.Body.String())
+}
+
+func TestParseForcedErrorStatusCodes(t *testing.T) {
+	for _, code := range []int{410, 451, 500} {
+		route, err := NewRedirect("./example", []byte(fmt.Sprintf("/gone /test.json %d", code)))
+		require.NoError(t, err)
+
+		req, _ := http.NewRequest("GET", "/gone", nil)
+		resp := testRequest(route, req)
+		require.Equal(t, code, resp.Code)
+		require.Equal(t, "{\"foo\": \"bar\"}\n", resp.Body.String())
+	}
+}
+
+func TestParseForcedErrorWithoutFile(t *testing.T) {
+	route, err := NewRedirect("./example", []byte("/gone /not-exist.html 410!"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/gone", nil)
+	resp := testRequest(route, req)
+	require.Equal(t, 410, resp.Code)
+	require.Equal(t, "Gone\n", resp.Body.String())
+}
+
+func TestParseRewriteFallThrough(t *testing.T) {
+	route, err := NewRedirect("./example", []byte("/docs/* /docs/v2/:splat 200"))
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/docs/intro.html", nil)
+	require.True(t, route.Match(req))
+
+	rec := httptest.NewRecorder()
+	require.True(t, route.Handle(rec, req))
+	require.False(t, rec.Flushed)
+	require.Equal(t, "", rec.Body.String())
+}
+
+func TestParseRewriteTraversal(t *testing.T) {
+	route, err := NewRedirect("./example", []byte("/files/* /about/:splat 200"))
+	require.NoError(t, err)
+
+	for _, p := range []string{"/files/../../redirect.go", "/files/../_redirects", "/files/%2e%2e/%2e%2e/redirect.go"} {
+		req, _ := http.NewRequest("GET", p, nil)
+		rec := httptest.NewRecorder()
+		require.True(t, route.Handle(rec, req), p)
+		require.Equal(t, "", rec.Body.String())
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// hookWriter runs hooks right before the response header is written.
+// It allows a middleware to modify headers which are set later in the chain,
+// such as headers of a proxied response.
+// It also keeps track of how the response is generated, so hooks can decide what to do.
+type hookWriter struct {
+	http.ResponseWriter
+	hooks       []func(http.Header)
+	lastHooks   []func(http.Header)
+	wroteHeader bool
+	// status is the status code of the response, it's available when hooks run
+	status int
+	// rewritten is true if the response is the content of a rewrite destination
+	rewritten bool
+	// proxied is true if the response is from a proxied server
+	proxied bool
+}
+
+func (hw *hookWriter) WriteHeader(status int) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		hw.status = status
+		for _, hook := range hw.hooks {
+			hook(hw.Header())
+		}
+		for _, hook := range hw.lastHooks {
+			hook(hw.Header())
+		}
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *hookWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(200)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// onWriteHeader registers a hook which runs right before the response header is written.
+// The hook runs immediately if the response writer doesn't support hooks.
+func onWriteHeader(w http.ResponseWriter, hook func(http.Header)) {
+	if hw, ok := w.(*hookWriter); ok && !hw.wroteHeader {
+		hw.hooks = append(hw.hooks, hook)
+		return
+	}
+	hook(w.Header())
+}
+
+// onWriteHeaderLast works like onWriteHeader, but the hook runs after all hooks registered by onWriteHeader
+func onWriteHeaderLast(w http.ResponseWriter, hook func(http.Header)) {
+	if hw, ok := w.(*hookWriter); ok && !hw.wroteHeader {
+		hw.lastHooks = append(hw.lastHooks, hook)
+		return
+	}
+	hook(w.Header())
+}
+
+// markRewritten marks the response as the content of a rewrite destination
+func markRewritten(w http.ResponseWriter) {
+	if hw, ok := w.(*hookWriter); ok {
+		hw.rewritten = true
+	}
+}
+
+// markProxied marks the response as a proxied response
+func markProxied(w http.ResponseWriter) {
+	if hw, ok := w.(*hookWriter); ok {
+		hw.proxied = true
+	}
+}
+
+type contextKey int
+
+const rewrittenKey contextKey = iota
+
+// rewrittenRequest returns a copy of the request with its path replaced by the rewrite destination
+func rewrittenRequest(r *http.Request, path string) *http.Request {
+	rewritten := r.WithContext(context.WithValue(r.Context(), rewrittenKey, true))
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	rewritten.URL = &u
+	return rewritten
+}
+
+// isRewritten returns true if the request is created by rewrittenRequest
+func isRewritten(r *http.Request) bool {
+	rewritten, _ := r.Context().Value(rewrittenKey).(bool)
+	return rewritten
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHookWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &hookWriter{ResponseWriter: rec}
+
+	calls := 0
+	onWriteHeader(w, func(h http.Header) {
+		calls++
+		h.Del("X-Upstream")
+	})
+	w.Header().Set("X-Upstream", "foo")
+	w.Write([]byte("hello"))
+	w.Write([]byte(" world"))
+
+	require.Equal(t, 1, calls)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "", rec.Header().Get("X-Upstream"))
+	require.Equal(t, "hello world", rec.Body.String())
+}
+
+func TestOnWriteHeaderWithoutHookWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("X-Upstream", "foo")
+	onWriteHeader(rec, func(h http.Header) {
+		h.Del("X-Upstream")
+	})
+	require.Equal(t, "", rec.Header().Get("X-Upstream"))
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 
 	"net"
+	"time"
 )
 
 // Server is an instance of SiteX server
@@ -20,18 +21,57 @@ func (s *Server) Start(listener net.Listener) {
 	http.Serve(listener, s.router)
 }
 
+// Config contains options of a SiteX server
+type Config struct {
+	// TrailingSlash is the policy of trailing slashes, it applies to redirect rules, header rules and static files
+	TrailingSlash TrailingSlash
+	// CaseSensitive disables case-insensitive path matching of redirect and header rules
+	CaseSensitive bool
+	// SPA serves index.html for unmatched client-side routes of a single-page application
+	SPA bool
+	// Compress enables on-the-fly gzip and Brotli compression of text-like responses
+	Compress bool
+	// CachePolicy is the default Cache-Control of served files. DefaultCachePolicy is used if it's nil
+	CachePolicy *CachePolicy
+	// HeaderPolicy decides which responses get headers defined in _headers
+	HeaderPolicy HeaderPolicy
+	// Password protects the whole site with a login form. It can be hashed like passwords of Basic-Auth
+	Password string
+	// PasswordExempt are paths accessible without the site password, such as `/robots.txt`
+	PasswordExempt []string
+	// SessionSecret signs session cookies of the site password. A random secret is used if it's empty
+	SessionSecret string
+	// SessionMaxAge is how long a login lasts. DefaultSessionMaxAge is used if it's zero
+	SessionMaxAge time.Duration
+	// TrustedProxies are CIDRs of reverse proxies whose X-Forwarded-For is trusted to find the client IP
+	TrustedProxies []string
+}
+
 // NewServer creates a new server serving given directory.
-// It follows the rules defined in `_redirects` and `_headers` files.
-func NewServer(directory string) (*Server, error) {
+// It follows the rules defined in `_redirects`, `_headers` and `_ratelimits` files.
+func NewServer(directory string, config Config) (*Server, error) {
 	var err error
 
+	if config.CachePolicy == nil {
+		config.CachePolicy = &DefaultCachePolicy
+	}
+
 	redirectConfig := filepath.Join(directory, "_redirects")
 	headerConfig := filepath.Join(directory, "_headers")
 
 	var headers []middleware
 	data, err := ioutil.ReadFile(headerConfig)
 	if err == nil {
-		headers, err = loadHeaders(directory, data)
+		headers, err = loadHeaders(directory, data, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rateLimits []middleware
+	data, err = ioutil.ReadFile(filepath.Join(directory, "_ratelimits"))
+	if err == nil {
+		rateLimits, err = loadRateLimits(data, config)
 		if err != nil {
 			return nil, err
 		}
@@ -41,25 +81,68 @@ func NewServer(directory string) (*Server, error) {
 	var nonShadowingRedirects []middleware
 	data, err = ioutil.ReadFile(redirectConfig)
 	if err == nil {
-		shadowingRedirects, nonShadowingRedirects, err = loadRedirects(directory, data)
+		shadowingRedirects, nonShadowingRedirects, err = loadRedirects(directory, data, headers, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fileServer := FileServer{WorkingDir: directory, TrailingSlash: config.TrailingSlash, CachePolicy: config.CachePolicy}
+	var fallbacks []middleware
+	if config.SPA {
+		fallbacks = append(fallbacks, SPA{WorkingDir: directory, CachePolicy: config.CachePolicy})
+	}
+	var guards []middleware
+	if config.Password != "" {
+		sitePassword, err := NewSitePassword(directory, config.Password, config.SessionSecret, config.PasswordExempt)
 		if err != nil {
 			return nil, err
 		}
+		sitePassword.CaseSensitive = config.CaseSensitive
+		if config.SessionMaxAge > 0 {
+			sitePassword.MaxAge = config.SessionMaxAge
+		}
+		guards = append(guards, sitePassword)
+	}
+	var normalize []middleware
+	if config.TrailingSlash != TrailingSlashAsIs {
+		normalize = append(normalize, TrailingSlashRedirect{WorkingDir: directory, TrailingSlash: config.TrailingSlash})
+	}
+	mainRouter := MainRouter{
+		normalize:             normalize,
+		rateLimits:            rateLimits,
+		guards:                guards,
+		headers:               headers,
+		shadowingRedirects:    shadowingRedirects,
+		nonShadowingRedirects: nonShadowingRedirects,
+		fileServer:            fileServer,
+		fallbacks:             fallbacks,
+		compress:              config.Compress,
 	}
-	fileServer := FileServer{directory}
-	mainRouter := MainRouter{headers, shadowingRedirects, nonShadowingRedirects, fileServer}
 
 	return &Server{mainRouter}, nil
 }
 
-func loadHeaders(directory string, config []byte) ([]middleware, error) {
-	return NewHeaders(config)
+func loadHeaders(directory string, rules []byte, config Config) ([]middleware, error) {
+	headers, err := newHeaders(directory, rules)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range headers {
+		header.(*Header).CaseSensitive = config.CaseSensitive
+		header.(*Header).Policy = config.HeaderPolicy
+		header.(*Header).TrustedProxies = trustedProxies
+	}
+	return headers, nil
 }
 
-func loadRedirects(directory string, config []byte) ([]middleware, []middleware, error) {
+func loadRedirects(directory string, rules []byte, headers []middleware, config Config) ([]middleware, []middleware, error) {
 	shadowingRedirects := make([]middleware, 0)
 	nonShadowingRedirects := make([]middleware, 0)
-	lines := bytes.Split(config, []byte("\n"))
+	lines := bytes.Split(rules, []byte("\n"))
 	for _, line := range lines {
 		redirect, err := NewRedirect(directory, line)
 		if err != nil {
@@ -69,6 +152,10 @@ func loadRedirects(directory string, config []byte) ([]middleware, []middleware,
 		if redirect == nil {
 			continue
 		}
+		redirect.CaseSensitive = config.CaseSensitive
+		redirect.CachePolicy = config.CachePolicy
+		redirect.Headers = headers
+		redirect.HeaderMatch = config.HeaderPolicy.Match
 		if redirect.Shadowing {
 			shadowingRedirects = append(shadowingRedirects, redirect)
 		} else {
@@ -77,3 +164,25 @@ func loadRedirects(directory string, config []byte) ([]middleware, []middleware,
 	}
 	return shadowingRedirects, nonShadowingRedirects, nil
 }
+
+func loadRateLimits(rules []byte, config Config) ([]middleware, error) {
+	trustedProxies, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	rateLimits := make([]middleware, 0)
+	for _, line := range bytes.Split(rules, []byte("\n")) {
+		rateLimit, err := NewRateLimit(line)
+		if err != nil {
+			return nil, err
+		}
+		// comment line
+		if rateLimit == nil {
+			continue
+		}
+		rateLimit.CaseSensitive = config.CaseSensitive
+		rateLimit.TrustedProxies = trustedProxies
+		rateLimits = append(rateLimits, rateLimit)
+	}
+	return rateLimits, nil
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -10,12 +13,15 @@ import (
 
 	"io"
 	"net"
+
+	"bufio"
+	"fmt"
 )
 
 func TestExampleServer(t *testing.T) {
 	mockProxy()
 
-	server, err := NewServer("./example")
+	server, err := NewServer("./example", Config{})
 	require.NoError(t, err)
 	listener, err := net.Listen("tcp", ":9069")
 	require.NoError(t, err)
@@ -108,6 +114,413 @@ func TestExampleServer(t *testing.T) {
 	require.Equal(t, "{\n  \"shadowed\": false\n}", string(body))
 }
 
+func TestRewriteCascade(t *testing.T) {
+	server := testServer(t, Config{}, map[string]string{
+		"_redirects":         "/docs/* /docs/v2/:splat 200\n/docs/* /docs/v1/:splat 200",
+		"docs/v2/new.html":   "v2",
+		"docs/v1/new.html":   "v1",
+		"docs/v1/intro.html": "v1 intro",
+	})
+
+	rec := serve(server, "GET", "/docs/new.html")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "v2", rec.Body.String())
+
+	rec = serve(server, "GET", "/docs/intro.html")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "v1 intro", rec.Body.String())
+
+	rec = serve(server, "GET", "/docs/missing.html")
+	require.Equal(t, 404, rec.Code)
+}
+
+func TestSPAServer(t *testing.T) {
+	server := testServer(t, Config{SPA: true}, map[string]string{
+		"_redirects": "/old /new",
+		"index.html": "app",
+		"app.js":     "js",
+	})
+
+	rec := serveHTML(server, "/users/42")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "app", rec.Body.String())
+
+	rec = serveHTML(server, "/app.js")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "js", rec.Body.String())
+
+	rec = serveHTML(server, "/old")
+	require.Equal(t, 301, rec.Code)
+
+	rec = serveHTML(server, "/missing.png")
+	require.Equal(t, 404, rec.Code)
+}
+
+func TestDefaultCachePolicy(t *testing.T) {
+	files := map[string]string{
+		"_headers":         "/nocache/*\n  Cache-Control: no-store",
+		"_redirects":       "/home /index.html 200",
+		"index.html":       "home",
+		"main.3f2a9c1b.js": "js",
+		"nocache/a.html":   "a",
+	}
+	server := testServer(t, Config{}, files)
+
+	rec := serve(server, "GET", "/index.html")
+	require.Equal(t, "public, max-age=0, must-revalidate", rec.Header().Get("Cache-Control"))
+
+	rec = serve(server, "GET", "/home")
+	require.Equal(t, "public, max-age=0, must-revalidate", rec.Header().Get("Cache-Control"))
+
+	rec = serve(server, "GET", "/main.3f2a9c1b.js")
+	require.Equal(t, "public, max-age=31536000, immutable", rec.Header().Get("Cache-Control"))
+
+	rec = serve(server, "GET", "/nocache/a.html")
+	require.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	server = testServer(t, Config{CachePolicy: &CachePolicy{}}, files)
+	rec = serve(server, "GET", "/index.html")
+	require.Equal(t, "", rec.Header().Get("Cache-Control"))
+}
+
+func TestUnsetHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Powered-By", "PHP")
+		w.Header().Set("X-Upstream", "yes")
+		w.Write([]byte("api"))
+	}))
+	defer upstream.Close()
+
+	server := testServer(t, Config{}, map[string]string{
+		"_headers":          "/*\n  X-Frame-Options: DENY\n/embed/*\n  ! X-Frame-Options\n  ! Cache-Control\n/api/*\n  ! X-Powered-By",
+		"_redirects":        "/api/* " + upstream.URL + "/:splat 200",
+		"embed/widget.html": "widget",
+		"index.html":        "home",
+	})
+
+	rec := serve(server, "GET", "/index.html")
+	require.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"))
+
+	rec = serve(server, "GET", "/embed/widget.html")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "", rec.Header().Get("X-Frame-Options"))
+	require.Equal(t, "", rec.Header().Get("Cache-Control"))
+	require.Equal(t, "widget", rec.Body.String())
+
+	rec = serve(server, "GET", "/api/users")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "", rec.Header().Get("X-Powered-By"))
+	require.Equal(t, "yes", rec.Header().Get("X-Upstream"))
+	require.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"))
+	require.Equal(t, "api", rec.Body.String())
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	}))
+	defer upstream.Close()
+
+	files := map[string]string{
+		"_headers":    "/*\n  X-Site: sitex\n/home\n  X-Original: home\n  X-Page: original\n/index.html\n  X-Rewritten: index\n  X-Page: rewritten\n/secret.html\n  Basic-Auth: user:pass",
+		"_redirects":  "/home /index.html 200\n/versioned /index.html?v=1 200\n/public /secret.html 200\n/old /home\n/api " + upstream.URL + " 200",
+		"index.html":  "home",
+		"secret.html": "secret",
+	}
+
+	server := testServer(t, Config{}, files)
+	rec := serve(server, "GET", "/home")
+	require.Equal(t, "home", rec.Body.String())
+	require.Equal(t, "home", rec.Header().Get("X-Original"))
+	require.Equal(t, "index", rec.Header().Get("X-Rewritten"))
+	require.Equal(t, "rewritten", rec.Header().Get("X-Page"))
+	require.Equal(t, "sitex", rec.Header().Get("X-Site"))
+
+	// the query string of the destination is not part of the file or header path
+	rec = serve(server, "GET", "/versioned")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "home", rec.Body.String())
+	require.Equal(t, "index", rec.Header().Get("X-Rewritten"))
+
+	// basic auth of the destination is enforced
+	rec = serve(server, "GET", "/public")
+	require.Equal(t, 401, rec.Code)
+
+	rec = serve(server, "GET", "/old")
+	require.Equal(t, 301, rec.Code)
+	require.Equal(t, "sitex", rec.Header().Get("X-Site"))
+
+	rec = serve(server, "GET", "/api")
+	require.Equal(t, "api", rec.Body.String())
+	require.Equal(t, "sitex", rec.Header().Get("X-Site"))
+
+	server = testServer(t, Config{HeaderPolicy: HeaderPolicy{Match: HeaderMatchRewritten}}, files)
+	rec = serve(server, "GET", "/home")
+	require.Equal(t, "", rec.Header().Get("X-Original"))
+	require.Equal(t, "index", rec.Header().Get("X-Rewritten"))
+	require.Equal(t, "rewritten", rec.Header().Get("X-Page"))
+	require.Equal(t, "sitex", rec.Header().Get("X-Site"))
+	rec = serve(server, "GET", "/index.html")
+	require.Equal(t, "index", rec.Header().Get("X-Rewritten"))
+
+	server = testServer(t, Config{HeaderPolicy: HeaderPolicy{Match: HeaderMatchOriginal}}, files)
+	rec = serve(server, "GET", "/home")
+	require.Equal(t, "home", rec.Header().Get("X-Original"))
+	require.Equal(t, "", rec.Header().Get("X-Rewritten"))
+	require.Equal(t, "original", rec.Header().Get("X-Page"))
+	rec = serve(server, "GET", "/public")
+	require.Equal(t, 200, rec.Code)
+
+	server = testServer(t, Config{HeaderPolicy: HeaderPolicy{SkipRedirects: true, SkipProxy: true}}, files)
+	rec = serve(server, "GET", "/old")
+	require.Equal(t, 301, rec.Code)
+	require.Equal(t, "", rec.Header().Get("X-Site"))
+	rec = serve(server, "GET", "/api")
+	require.Equal(t, "api", rec.Body.String())
+	require.Equal(t, "", rec.Header().Get("X-Site"))
+	rec = serve(server, "GET", "/home")
+	require.Equal(t, "sitex", rec.Header().Get("X-Site"))
+}
+
+func TestBasicAuthFileIsNotServed(t *testing.T) {
+	server := testServer(t, Config{}, map[string]string{
+		"_headers":            "/admin/*\n  Basic-Auth-File: auth/users.htpasswd",
+		"_redirects":          "/users /auth/users.htpasswd 200",
+		"auth/users.htpasswd": "alice:$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0\n",
+		"admin/index.html":    "admin",
+	})
+
+	rec := serve(server, "GET", "/auth/users.htpasswd")
+	require.Equal(t, 404, rec.Code)
+	rec = serve(server, "GET", "/users")
+	require.Equal(t, 404, rec.Code)
+
+	rec = serve(server, "GET", "/admin/")
+	require.Equal(t, 401, rec.Code)
+}
+
+func TestHeaderMethodAuthMatrix(t *testing.T) {
+	ts := mockServer()
+	defer ts.Close()
+	server := testServer(t, Config{}, map[string]string{
+		"_headers": `
+/*
+  X-All: yes
+/admin/*
+  Basic-Auth: admin:secret
+  X-Admin: yes
+/api/*
+  WWW-Authenticate: Bearer realm="api"
+  X-Api: yes
+/admin/api/*
+  Basic-Auth: api:token
+`,
+		"_redirects":       "/api/* " + ts.URL + "/:splat 200\n/admin/api/* " + ts.URL + "/:splat 200",
+		"index.html":       "home",
+		"admin/index.html": "admin",
+	})
+
+	cases := []struct {
+		method   string
+		url      string
+		user     string
+		password string
+		code     int
+		headers  []string
+	}{
+		{"GET", "/", "", "", 200, []string{"X-All"}},
+		{"HEAD", "/", "", "", 200, []string{"X-All"}},
+		{"OPTIONS", "/", "", "", 200, []string{"X-All"}},
+		{"GET", "/admin/", "", "", 401, nil},
+		{"HEAD", "/admin/", "", "", 401, nil},
+		{"OPTIONS", "/admin/", "", "", 401, nil},
+		{"POST", "/admin/", "", "", 401, nil},
+		{"GET", "/admin/", "admin", "wrong", 401, nil},
+		{"GET", "/admin/", "admin", "secret", 200, []string{"X-All", "X-Admin"}},
+		{"HEAD", "/admin/", "admin", "secret", 200, []string{"X-All", "X-Admin"}},
+		{"OPTIONS", "/admin/", "admin", "secret", 200, []string{"X-All", "X-Admin"}},
+		// a WWW-Authenticate header defined in _headers is not an auth failure
+		{"GET", "/api/users", "", "", 200, []string{"X-All", "X-Api"}},
+		{"POST", "/api/users", "", "", 200, []string{"X-All", "X-Api"}},
+		{"OPTIONS", "/api/users", "", "", 200, []string{"X-All", "X-Api"}},
+		// overlapping blocks with different credentials must all pass
+		{"POST", "/admin/api/users", "admin", "secret", 401, nil},
+		{"POST", "/admin/api/users", "api", "token", 401, nil},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(c.method, c.url, nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+		server.router.ServeHTTP(rec, req)
+		name := c.method + " " + c.url + " " + c.user
+		require.Equal(t, c.code, rec.Code, name)
+		for _, h := range c.headers {
+			require.Equal(t, "yes", rec.Header().Get(h), name+" "+h)
+		}
+		if c.code == 401 {
+			require.Contains(t, rec.Header().Get("WWW-Authenticate"), "Basic", name)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/users", nil)
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, "METHOD: POST", rec.Body.String())
+	require.Equal(t, `Bearer realm="api"`, rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestIPAllowAndDeny(t *testing.T) {
+	server := testServer(t, Config{TrustedProxies: []string{"127.0.0.1"}}, map[string]string{
+		"_headers": `
+/preview/*
+  IP-Allow: 10.8.0.0/16, 192.168.1.5
+  IP-Deny: 10.8.9.0/24
+/*
+  IP-Deny: 198.51.100.0/24
+`,
+		"index.html":         "home",
+		"preview/index.html": "preview",
+	})
+
+	cases := []struct {
+		remote    string
+		forwarded string
+		url       string
+		code      int
+	}{
+		{"10.8.1.2:1000", "", "/preview/", 200},
+		{"192.168.1.5:1000", "", "/preview/", 200},
+		{"10.8.9.1:1000", "", "/preview/", 403},
+		{"203.0.113.7:1000", "", "/preview/", 403},
+		{"203.0.113.7:1000", "", "/", 200},
+		{"198.51.100.1:1000", "", "/", 403},
+		// a request through the trusted proxy
+		{"127.0.0.1:1000", "10.8.1.2", "/preview/", 200},
+		{"127.0.0.1:1000", "203.0.113.7", "/preview/", 403},
+		// an untrusted client can't spoof its address
+		{"203.0.113.7:1000", "10.8.1.2", "/preview/", 403},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", c.url, nil)
+		req.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		server.router.ServeHTTP(rec, req)
+		require.Equal(t, c.code, rec.Code, c.remote+" "+c.forwarded+" "+c.url)
+	}
+
+	_, err := NewServer(testDir(t, map[string]string{"_headers": "/*\n  IP-Allow: office"}), Config{})
+	require.Error(t, err)
+	_, err = NewServer(testDir(t, map[string]string{"_headers": "/*\n  X-Foo: bar"}), Config{TrustedProxies: []string{"proxy"}})
+	require.Error(t, err)
+}
+
+func TestRateLimitedProxy(t *testing.T) {
+	ts := mockServer()
+	defer ts.Close()
+	server := testServer(t, Config{TrustedProxies: []string{"127.0.0.1"}}, map[string]string{
+		"_ratelimits": "/api/* 2/1m",
+		"_redirects":  "/api/* " + ts.URL + "/:splat 200",
+		"index.html":  "home",
+	})
+
+	send := func(method string, url string, forwarded string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, nil)
+		req.RemoteAddr = "127.0.0.1:1000"
+		req.Header.Set("X-Forwarded-For", forwarded)
+		server.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, "METHOD: POST", send("POST", "/api/users", "203.0.113.7").Body.String())
+	require.Equal(t, 200, send("GET", "/api/users", "203.0.113.7").Code)
+	rec := send("POST", "/api/users", "203.0.113.7")
+	require.Equal(t, 429, rec.Code)
+	require.Equal(t, "30", rec.Header().Get("Retry-After"))
+
+	require.Equal(t, 200, send("GET", "/api/users", "203.0.113.8").Code)
+	require.Equal(t, 200, send("GET", "/", "203.0.113.7").Code)
+	require.Equal(t, 404, send("GET", "/_ratelimits", "203.0.113.8").Code)
+
+	_, err := NewServer(testDir(t, map[string]string{"_ratelimits": "/api/* fast"}), Config{})
+	require.Error(t, err)
+}
+
+func TestDotDotCannotBypassRules(t *testing.T) {
+	server := testServer(t, Config{}, map[string]string{
+		"_headers":          "/admin/*\n  Basic-Auth: user:pass",
+		"admin/secret.html": "secret",
+	})
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	// send raw requests, so the paths are not cleaned by the client
+	raw := func(path string) string {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", path)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		require.NotEqual(t, "secret", string(body), path)
+		return res.Status
+	}
+
+	require.Equal(t, "401 Unauthorized", raw("/admin/secret.html"))
+	require.Equal(t, "400 Bad Request", raw("/x/../admin/secret.html"))
+	require.Equal(t, "400 Bad Request", raw("/foo/%2e%2e/admin/secret.html"))
+	require.Equal(t, "401 Unauthorized", raw("//admin/secret.html"))
+	require.Equal(t, "401 Unauthorized", raw("/./admin/./secret.html"))
+}
+
+func TestTrailingSlashPolicyAppliesToRules(t *testing.T) {
+	files := map[string]string{
+		"_redirects":      "/old /new 301\n/api/* /new.html 200 Method=GET,POST",
+		"_headers":        "/docs/\n  X-Docs: yes",
+		"docs/index.html": "docs",
+		"new.html":        "new",
+	}
+
+	server := testServer(t, Config{TrailingSlash: TrailingSlashStrip}, files)
+	rec := serve(server, "GET", "/old/?a=1")
+	require.Equal(t, 301, rec.Code)
+	require.Equal(t, "/old?a=1", rec.Header().Get("Location"))
+	rec = serve(server, "GET", "/old")
+	require.Equal(t, "/new", rec.Header().Get("Location"))
+	rec = serve(server, "GET", "/docs/")
+	require.Equal(t, "/docs", rec.Header().Get("Location"))
+	rec = serve(server, "GET", "/docs")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "yes", rec.Header().Get("X-Docs"))
+	// other methods are never redirected
+	rec = serve(server, "POST", "/api/users/")
+	require.Equal(t, 200, rec.Code)
+
+	server = testServer(t, Config{TrailingSlash: TrailingSlashAdd}, files)
+	rec = serve(server, "GET", "/docs")
+	require.Equal(t, 301, rec.Code)
+	require.Equal(t, "/docs/", rec.Header().Get("Location"))
+	rec = serve(server, "GET", "/new.html/")
+	require.Equal(t, "/new.html", rec.Header().Get("Location"))
+	// paths which are not static files are matched as-is
+	rec = serve(server, "GET", "/old/")
+	require.Equal(t, "/new", rec.Header().Get("Location"))
+
+	server = testServer(t, Config{}, files)
+	rec = serve(server, "GET", "/old/")
+	require.Equal(t, "/new", rec.Header().Get("Location"))
+	rec = serve(server, "GET", "/docs")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "yes", rec.Header().Get("X-Docs"))
+}
+
 func sendReq(method string, url string) (*http.Response, error) {
 	req, _ := http.NewRequest(method, url, nil)
 	client := http.Client{
@@ -136,3 +549,39 @@ func mockProxy() {
 	go http.ListenAndServe(":9090", nil)
 
 }
+
+// testServer creates a server serving a temporary directory with given files
+func testServer(t *testing.T, config Config, files map[string]string) *Server {
+	server, err := NewServer(testDir(t, files), config)
+	require.NoError(t, err)
+	return server
+}
+
+// testDir creates a temporary directory with given files
+func testDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "sitex")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		require.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+	}
+	return dir
+}
+
+func serve(server *Server, method string, url string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, nil)
+	server.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func serveHTML(server *Server, url string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", "text/html")
+	server.router.ServeHTTP(rec, req)
+	return rec
+}
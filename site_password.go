@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// loginPath is the endpoint of the login form, it's hidden so it never clashes with site files
+	loginPath = "/.sitex/login"
+	// sessionCookie is the name of the session cookie issued after login
+	sessionCookie = "sitex_session"
+	// passwordPage is the site file which overrides the default login page
+	passwordPage = "_password.html"
+)
+
+// DefaultSessionMaxAge is how long a login lasts by default
+const DefaultSessionMaxAge = 7 * 24 * time.Hour
+
+var defaultLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Password required</title>
+</head>
+<body>
+<form method="POST" action="{{.Action}}">
+<h1>Password required</h1>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+<input type="password" name="password" autofocus required>
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+// loginForm is the data of the login page template
+type loginForm struct {
+	// Action is where the form should be posted to
+	Action string
+	// Redirect is where the user goes after login
+	Redirect string
+	// Error is set if the password was wrong
+	Error string
+}
+
+// SitePassword protects the whole site with a password.
+// Visitors log in with a form instead of the Basic-Auth prompt of browsers,
+// and get a signed session cookie which expires after MaxAge.
+type SitePassword struct {
+	// Password can be hashed like passwords of Basic-Auth
+	Password string
+	// Secret signs session cookies
+	Secret []byte
+	MaxAge time.Duration
+	// Exempt are paths which don't require the password, such as `/robots.txt`
+	Exempt        []*pattern
+	CaseSensitive bool
+	page          *template.Template
+}
+
+// NewSitePassword returns a site-wide password protection of the directory.
+// The login page can be overridden by a `_password.html` template in the directory.
+// A random secret is generated if secret is empty, so sessions don't survive a restart.
+func NewSitePassword(wd string, password string, secret string, exempt []string) (*SitePassword, error) {
+	if err := validatePassword(password); err != nil {
+		return nil, fmt.Errorf("Invalid site password: %v", err)
+	}
+	sp := &SitePassword{Password: password, Secret: []byte(secret), MaxAge: DefaultSessionMaxAge, page: defaultLoginPage}
+	if secret == "" {
+		sp.Secret = make([]byte, 32)
+		if _, err := rand.Read(sp.Secret); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, raw := range exempt {
+		if strings.HasSuffix(raw, "*") {
+			raw = raw + "splat"
+		}
+		p, err := newPattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		sp.Exempt = append(sp.Exempt, p)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(wd, passwordPage))
+	if err == nil {
+		sp.page, err = template.New("login").Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// Match returns true if the request requires the password
+func (sp *SitePassword) Match(r *http.Request) bool {
+	if r.URL.Path == loginPath {
+		return true
+	}
+	for _, p := range sp.Exempt {
+		if _, ok := p.match(r.URL.Path, sp.CaseSensitive); ok {
+			return false
+		}
+	}
+	return !sp.validSession(r, time.Now())
+}
+
+// Handle logs the user in, or shows the login page if the request isn't logged in
+func (sp *SitePassword) Handle(w http.ResponseWriter, r *http.Request) bool {
+	if !sp.Match(r) {
+		return true
+	}
+	if r.URL.Path == loginPath {
+		sp.login(w, r)
+		return false
+	}
+
+	redirect := r.URL.RequestURI()
+	if r.Method != "GET" && r.Method != "HEAD" {
+		redirect = "/"
+	}
+	sp.renderLogin(w, r, loginForm{Action: loginPath, Redirect: redirect})
+	return false
+}
+
+// login checks the posted password and issues a session cookie
+func (sp *SitePassword) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		return
+	}
+
+	redirect := r.PostFormValue("redirect")
+	// only local paths, so the form can't be used as an open redirect
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = "/"
+	}
+	if !checkPassword(sp.Password, r.PostFormValue("password")) {
+		sp.renderLogin(w, r, loginForm{Action: loginPath, Redirect: redirect, Error: "Wrong password."})
+		return
+	}
+
+	expires := time.Now().Add(sp.MaxAge)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sp.sign(expires),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(sp.MaxAge / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, redirect, 303)
+}
+
+// renderLogin replies with the login page and status 401
+func (sp *SitePassword) renderLogin(w http.ResponseWriter, r *http.Request, form loginForm) {
+	var body bytes.Buffer
+	if err := sp.page.Execute(&body, form); err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(401)
+	if r.Method != "HEAD" {
+		w.Write(body.Bytes())
+	}
+}
+
+// sign returns a session cookie value which expires at the given time.
+// The password is signed as well, so changing it logs everyone out.
+func (sp *SitePassword) sign(expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + hex.EncodeToString(sp.mac(exp))
+}
+
+// validSession returns true if the request has a valid and unexpired session cookie
+func (sp *SitePassword) validSession(r *http.Request, now time.Time) bool {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() >= exp {
+		return false
+	}
+	sig, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, sp.mac(parts[0]))
+}
+
+func (sp *SitePassword) mac(exp string) []byte {
+	h := hmac.New(sha256.New, sp.Secret)
+	h.Write([]byte(exp))
+	h.Write([]byte{0})
+	h.Write([]byte(sp.Password))
+	return h.Sum(nil)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSitePassword(t *testing.T) {
+	server := testServer(t, Config{Password: "secret", PasswordExempt: []string{"/robots.txt", "/.well-known/*"}}, map[string]string{
+		"index.html":               "home",
+		"robots.txt":               "User-agent: *",
+		".well-known/security.txt": "Contact: me",
+		"docs/index.html":          "docs",
+	})
+
+	rec := serve(server, "GET", "/docs/?page=2")
+	require.Equal(t, 401, rec.Code)
+	require.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	require.Contains(t, rec.Body.String(), `action="/.sitex/login"`)
+	require.Contains(t, rec.Body.String(), `value="/docs/?page=2"`)
+
+	rec = serve(server, "GET", "/robots.txt")
+	require.Equal(t, 200, rec.Code)
+	rec = serve(server, "GET", "/.well-known/security.txt")
+	require.Equal(t, 200, rec.Code)
+
+	// wrong password
+	rec = login(server, "wrong", "/docs/")
+	require.Equal(t, 401, rec.Code)
+	require.Contains(t, rec.Body.String(), "Wrong password.")
+	require.Empty(t, rec.Result().Cookies())
+
+	rec = login(server, "secret", "/docs/")
+	require.Equal(t, 303, rec.Code)
+	require.Equal(t, "/docs/", rec.Header().Get("Location"))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.True(t, cookies[0].HttpOnly)
+
+	rec = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/docs/", nil)
+	req.AddCookie(cookies[0])
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "docs", rec.Body.String())
+
+	// the login form can't redirect to other sites
+	rec = login(server, "secret", "//example.com")
+	require.Equal(t, "/", rec.Header().Get("Location"))
+
+	rec = serve(server, "GET", loginPath)
+	require.Equal(t, 405, rec.Code)
+}
+
+func TestSitePasswordSession(t *testing.T) {
+	sp, err := NewSitePassword("", "secret", "key", nil)
+	require.NoError(t, err)
+	now := time.Now()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	require.False(t, sp.validSession(req, now))
+
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: sp.sign(now.Add(time.Hour))})
+	require.True(t, sp.validSession(req, now))
+	// expired
+	require.False(t, sp.validSession(req, now.Add(2*time.Hour)))
+
+	// signed with another secret or another password
+	other, err := NewSitePassword("", "secret", "another key", nil)
+	require.NoError(t, err)
+	require.False(t, other.validSession(req, now))
+	other, err = NewSitePassword("", "changed", "key", nil)
+	require.NoError(t, err)
+	require.False(t, other.validSession(req, now))
+
+	// tampered expiry
+	value := sp.sign(now.Add(time.Hour))
+	tampered := "9" + value
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: tampered})
+	require.False(t, sp.validSession(req, now))
+}
+
+func TestSitePasswordCustomPage(t *testing.T) {
+	server := testServer(t, Config{Password: "secret"}, map[string]string{
+		"index.html":     "home",
+		"_password.html": `<form action="{{.Action}}"><input name="redirect" value="{{.Redirect}}">custom</form>`,
+	})
+
+	rec := serve(server, "GET", "/")
+	require.Equal(t, 401, rec.Code)
+	require.Equal(t, `<form action="/.sitex/login"><input name="redirect" value="/">custom</form>`, rec.Body.String())
+
+	// the template itself is not served, even after login
+	sp := server.router.guards[0].(*SitePassword)
+	rec = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_password.html", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: sp.sign(time.Now().Add(time.Hour))})
+	server.router.ServeHTTP(rec, req)
+	require.Equal(t, 404, rec.Code)
+
+	_, err := NewServer(testDir(t, map[string]string{"_password.html": "{{.Action"}), Config{Password: "secret"})
+	require.Error(t, err)
+}
+
+func TestSitePasswordExemptPathsAreCleaned(t *testing.T) {
+	sp, err := NewSitePassword("", "secret", "key", []string{"/robots.txt", "/.well-known/*"})
+	require.NoError(t, err)
+
+	for _, p := range []string{"/robots.txt", "/.well-known/security.txt"} {
+		req, _ := http.NewRequest("GET", p, nil)
+		require.False(t, sp.Match(req), p)
+	}
+
+	// the router cleans the path before the site password, and refuses `..`
+	server := testServer(t, Config{Password: "secret", PasswordExempt: []string{"/robots.txt", "/.well-known/*"}}, map[string]string{
+		"robots.txt":      "ROBOTS",
+		"docs/index.html": "DOCS",
+	})
+	for _, p := range []string{"/robots.txt", "/./robots.txt", "/.//robots.txt"} {
+		rec := serve(server, "GET", p)
+		require.Equal(t, 200, rec.Code, p)
+	}
+	for _, p := range []string{"/.well-known/../docs/", "/.well-known/%2e%2e/docs/"} {
+		rec := serve(server, "GET", p)
+		require.NotEqual(t, 200, rec.Code, p)
+		require.NotContains(t, rec.Body.String(), "DOCS", p)
+	}
+}
+
+func login(server *Server, password string, redirect string) *httptest.ResponseRecorder {
+	form := url.Values{"password": {password}, "redirect": {redirect}}
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", loginPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rec, req)
+	return rec
+}
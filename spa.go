@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SPA serves index.html for client-side routes of a single-page application.
+// It only handles GET requests of extension-less paths from browsers,
+// so missing assets such as `/app.js` still get a 404.
+type SPA struct {
+	WorkingDir  string
+	CachePolicy *CachePolicy
+}
+
+func (spa SPA) Match(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if filepath.Ext(trimTrailingSlash(r.URL.Path)) != "" {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// Handle serves index.html if the request is a client-side route
+func (spa SPA) Handle(w http.ResponseWriter, r *http.Request) bool {
+	if !spa.Match(r) {
+		return true
+	}
+	file, _, ok := resolveFile(spa.WorkingDir, "/index.html")
+	if !ok {
+		return true
+	}
+	spa.CachePolicy.apply(w.Header(), file)
+	serveFile(w, r, file)
+	return false
+}
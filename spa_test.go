@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSPA(t *testing.T) {
+	spa := SPA{WorkingDir: "./example/about"}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/users/42", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	require.True(t, spa.Match(req))
+	require.False(t, spa.Handle(rec, req))
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "<h1>about</h1>\n", rec.Body.String())
+
+	// assets
+	req, _ = http.NewRequest("GET", "/app.js", nil)
+	req.Header.Set("Accept", "text/html")
+	require.False(t, spa.Match(req))
+
+	// not a browser navigation
+	req, _ = http.NewRequest("GET", "/users/42", nil)
+	req.Header.Set("Accept", "application/json")
+	require.False(t, spa.Match(req))
+
+	req, _ = http.NewRequest("POST", "/users/42", nil)
+	req.Header.Set("Accept", "text/html")
+	require.False(t, spa.Match(req))
+}
+
+func TestSPAWithoutIndex(t *testing.T) {
+	spa := SPA{WorkingDir: "./example"}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/users/42", nil)
+	req.Header.Set("Accept", "text/html")
+	require.True(t, spa.Handle(rec, req))
+}